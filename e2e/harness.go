@@ -0,0 +1,252 @@
+// Package e2e runs middleton, laidback, an in-memory kafka and an in-memory
+// ledis speaking the redis protocol in one process, so the whole pipeline
+// can be tested without docker.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	laidback "github.com/yasukun/roure/laidback/lib"
+	"github.com/yasukun/roure/memkafka"
+	middleton "github.com/yasukun/roure/middleton/lib"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
+)
+
+var harnesses int64
+
+// Harness is one running pipeline. Every harness has a broker and a ledis
+// of its own, so tests using separate harnesses do not see each other.
+type Harness struct {
+	URL       string
+	Middleton middleton.Config
+	Laidback  laidback.Config
+	Broker    *memkafka.Broker
+	// Store reads the projection through the redis protocol server.
+	Store storage.Store
+
+	api        *httptest.Server
+	ledis      *storage.Server
+	supervisor *laidback.Supervisor
+	cancel     context.CancelFunc
+	clients    []storage.Store
+}
+
+// loadCodec reads schema and its previous versions from the schemaz
+// directory below root, in place of the bindata assets of the services.
+func loadCodec(root, schema, unframed string) (*avroreg.Codec, error) {
+	b, err := ioutil.ReadFile(filepath.Join(root, "schemaz", schema))
+	if err != nil {
+		return nil, err
+	}
+	var u []byte
+	if unframed != "" {
+		if u, err = ioutil.ReadFile(filepath.Join(root, "schemaz", unframed)); err != nil {
+			return nil, err
+		}
+	}
+	return avroreg.NewCodec(nil, string(b), string(u))
+}
+
+// middletonCodecs ...
+func middletonCodecs(root string, conf middleton.Config) (codecs middleton.Codecs, err error) {
+	if codecs.Subject, err = loadCodec(root, conf.Subject.Schema, conf.Subject.UnframedSchema); err != nil {
+		return
+	}
+	if codecs.Comment, err = loadCodec(root, conf.Comment.Schema, conf.Comment.UnframedSchema); err != nil {
+		return
+	}
+	if codecs.Activity, err = loadCodec(root, conf.Activity.Schema, conf.Activity.UnframedSchema); err != nil {
+		return
+	}
+	codecs.Metainfo, err = loadCodec(root, conf.Metainfo.Schema, "")
+	return
+}
+
+// Start runs the pipeline with the configs checked in below root, the
+// repository root. Both services are pointed at the in-memory broker and
+// at a redis protocol server in front of a memory store.
+func Start(root string) (*Harness, error) {
+	mconf, err := middleton.DecodeConfigToml(filepath.Join(root, "middleton", "middleton.toml"))
+	if err != nil {
+		return nil, err
+	}
+	lconf, err := laidback.DecodeConfigToml(filepath.Join(root, "laidback", "laidback.toml"))
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("e2e-%d", atomic.AddInt64(&harnesses, 1))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{ledis: storage.NewServer(name, l), Broker: memkafka.Named(name)}
+	go h.ledis.Serve()
+
+	mconf.Kafka.Backend = memkafka.BACKEND_MEMORY
+	mconf.Kafka.Brokers = []middleton.Broker{{Addr: name}}
+	mconf.Ledisdb.Backend = storage.BACKEND_REDIS
+	mconf.Ledisdb.Addr = h.ledis.Addr()
+	mconf.Ledisdb.Password = ""
+	mconf.Registry.URL = ""
+	lconf.Kafka.Backend = memkafka.BACKEND_MEMORY
+	lconf.Kafka.Brokers = []laidback.Broker{{Addr: name}}
+	lconf.Kafka.GroupID = ""
+	lconf.Ledisdb.Backend = storage.BACKEND_REDIS
+	lconf.Ledisdb.Addr = h.ledis.Addr()
+	lconf.Ledisdb.Password = ""
+	lconf.Registry.URL = ""
+	h.Middleton, h.Laidback = mconf, lconf
+	for _, topic := range lconf.Kafka.Topics {
+		h.Broker.CreateTopic(topic.Topic, topic.Partitions)
+	}
+
+	if h.Store, err = laidback.OpenStore(lconf, lconf.Ledisdb.DB); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := h.startLaidback(root); err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	codecs, err := middletonCodecs(root, mconf)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	client, err := storage.Open(storage.Options{
+		Backend: mconf.Ledisdb.Backend,
+		Addr:    mconf.Ledisdb.Addr,
+		DB:      mconf.Ledisdb.DB,
+	})
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.clients = append(h.clients, client)
+	h.api = httptest.NewServer(middleton.NewEcho(mconf, client, codecs))
+	h.URL = h.api.URL
+	return h, nil
+}
+
+// startLaidback spawns a supervised reader for every partition, the way
+// laidback does without a consumer group.
+func (h *Harness) startLaidback(root string) error {
+	conf := h.Laidback
+	if err := laidback.RegisterScripts(conf); err != nil {
+		return err
+	}
+	codecs := map[string]*avroreg.Codec{}
+	for _, topic := range conf.Kafka.Topics {
+		codec, err := loadCodec(root, topic.AvroSchema, topic.UnframedSchema)
+		if err != nil {
+			return err
+		}
+		codecs[topic.Topic] = codec
+	}
+	client, err := laidback.OpenStore(conf, conf.Ledisdb.DB)
+	if err != nil {
+		return err
+	}
+	h.clients = append(h.clients, client)
+	if err := laidback.LoadScripts(client); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.supervisor = laidback.NewSupervisor(conf)
+	laidback.SyncPartitions(ctx, conf, h.supervisor, true, func(ctx context.Context, topic laidback.TopicConfig, partition int) {
+		codec := codecs[topic.Topic]
+		h.supervisor.Go(ctx, topic.Topic, partition, func(ctx context.Context) error {
+			if err := laidback.SetOffsetNX(client, topic.Topic, partition); err != nil {
+				return err
+			}
+			return laidback.ReadKafka(ctx, conf, client, codec, topic, partition)
+		})
+	})
+	return nil
+}
+
+// Close stops the readers and the servers.
+func (h *Harness) Close() {
+	if h.api != nil {
+		h.api.Close()
+	}
+	if h.cancel != nil {
+		h.cancel()
+		h.supervisor.Wait()
+	}
+	for _, client := range h.clients {
+		client.Close()
+	}
+	if h.Store != nil {
+		h.Store.Close()
+	}
+	h.ledis.Close()
+}
+
+// do sends body as JSON and decodes a 200 response into out.
+func (h *Harness) do(method, path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, h.URL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Post ...
+func (h *Harness) Post(path string, body, out interface{}) error {
+	return h.do(http.MethodPost, path, body, out)
+}
+
+// Get ...
+func (h *Harness) Get(path string, out interface{}) error {
+	return h.do(http.MethodGet, path, nil, out)
+}
+
+// Wait polls cond until it returns true, an error or timeout passes.
+func (h *Harness) Wait(timeout time.Duration, cond func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := cond()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("condition not met after %v", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
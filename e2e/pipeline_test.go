@@ -0,0 +1,101 @@
+package e2e
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	middleton "github.com/yasukun/roure/middleton/lib"
+)
+
+func TestSubjectAndCommentPipeline(t *testing.T) {
+	h, err := Start("..")
+	if err != nil {
+		t.Fatalf("start harness error: %v", err)
+	}
+	defer h.Close()
+
+	var subject middleton.PostResponse
+	if err := h.Post("/api/subject/new/news", middleton.Subject{Name: "hello", Body: "first subject"}, &subject); err != nil {
+		t.Fatal(err)
+	}
+	if subject.ID == "" || subject.Category != "news" {
+		t.Fatalf("unexpected subject response: %+v", subject)
+	}
+
+	var latest []map[string]interface{}
+	err = h.Wait(5*time.Second, func() (bool, error) {
+		err := h.Get("/api/subject/latest/news", &latest)
+		return len(latest) > 0, err
+	})
+	if err != nil {
+		t.Fatalf("subject not projected: %v", err)
+	}
+	if len(latest) != 1 || latest[0]["id"] != subject.ID || latest[0]["name"] != "hello" {
+		t.Fatalf("unexpected latest subjects: %v", latest)
+	}
+
+	for _, body := range []string{"first comment", "second comment"} {
+		comment := middleton.Comment{Subjectid: subject.ID, Name: "anon", Body: body}
+		if err := h.Post("/api/comment/new/", comment, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var comments []map[string]interface{}
+	err = h.Wait(5*time.Second, func() (bool, error) {
+		err := h.Post("/api/comment/range/"+subject.ID, middleton.PostRange{Start: 0, Stop: 9}, &comments)
+		return len(comments) == 2, err
+	})
+	if err != nil {
+		t.Fatalf("comments not projected: %v (got %v)", err, comments)
+	}
+	for i, body := range []string{"first comment", "second comment"} {
+		if comments[i]["body"] != body || comments[i]["subjectid"] != subject.ID {
+			t.Fatalf("unexpected comment %d: %v", i, comments[i])
+		}
+	}
+}
+
+func TestSubjectProjectionRules(t *testing.T) {
+	h, err := Start("..")
+	if err != nil {
+		t.Fatalf("start harness error: %v", err)
+	}
+	defer h.Close()
+
+	// a producer that leaves the projection to the laidback rules
+	codec, err := loadCodec("..", h.Middleton.Subject.Schema, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := middleton.Subject{Id: "rule1", Category: "rules", Name: "by rule", Uts: 1527209139, Redis: []middleton.Command{}, Tags: []middleton.Tag{}, Images: []middleton.Image{}}
+	b, err := json.Marshal(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, _, err := codec.NativeFromTextual(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Broker.WriteMessages(h.Middleton.Subject.Topic, kafka.Message{Key: []byte("rules"), Value: value}); err != nil {
+		t.Fatal(err)
+	}
+
+	var latest []map[string]interface{}
+	err = h.Wait(5*time.Second, func() (bool, error) {
+		err := h.Get("/api/subject/latest/rules", &latest)
+		return len(latest) > 0, err
+	})
+	if err != nil {
+		t.Fatalf("subject not projected: %v", err)
+	}
+	if latest[0]["id"] != "rule1" || latest[0]["name"] != "by rule" {
+		t.Fatalf("unexpected latest subjects: %v", latest)
+	}
+}
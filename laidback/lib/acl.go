@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// ACLConfig limits the commands messages of a topic may carry. An empty
+// list allows everything for that part of a command. Keys are glob
+// patterns such as comment:subjectid:*, see matchGlob.
+type ACLConfig struct {
+	Groups []string `toml:"groups"`
+	Keys   []string `toml:"keys"`
+	Froms  []string `toml:"froms"`
+}
+
+type aclError struct {
+	Index  int
+	Cmd    Command
+	Reason string
+}
+
+func (e *aclError) Error() string {
+	return fmt.Sprintf("command %d (%s %s) rejected: %s", e.Index, e.Cmd.Group, e.Cmd.Key, e.Reason)
+}
+
+// reservedKey reports whether key holds laidback's own state, which no
+// message may write whatever the ACL says.
+func reservedKey(key string) bool {
+	return key == OFFSET_KEY || strings.HasPrefix(key, APPLIED_KEY_PREFIX) || strings.HasPrefix(key, LEASE_KEY_PREFIX)
+}
+
+// matchKey ...
+func matchKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether key matches pattern. * matches any run of
+// characters, separators such as : and / included, ? matches one
+// character and everything else matches itself.
+func matchGlob(pattern, key string) bool {
+	p, k := []rune(pattern), []rune(key)
+	pi, ki := 0, 0
+	// where to resume after the last *, trying one more character for it
+	starPi, starKi := -1, 0
+	for pi < len(p) || ki < len(k) {
+		if pi < len(p) {
+			switch {
+			case p[pi] == '*':
+				starPi, starKi = pi, ki+1
+				pi++
+				continue
+			case ki < len(k) && (p[pi] == '?' || p[pi] == k[ki]):
+				pi++
+				ki++
+				continue
+			}
+		}
+		if starPi >= 0 && starKi <= len(k) {
+			pi, ki = starPi+1, starKi
+			starKi++
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Check returns an *aclError for the first command acl does not allow.
+// A nil acl only protects the reserved keys.
+func (acl *ACLConfig) Check(cmds []Command) error {
+	for i, cmd := range cmds {
+		reason := ""
+		switch {
+		case reservedKey(cmd.Key):
+			reason = "reserved key"
+		case acl == nil:
+		case len(acl.Groups) > 0 && !contains(acl.Groups, cmd.Group):
+			reason = "group not allowed"
+		case len(acl.Keys) > 0 && !matchKey(acl.Keys, cmd.Key):
+			reason = "key not allowed"
+		case len(acl.Froms) > 0 && !contains(acl.Froms, cmd.From):
+			reason = "from not allowed"
+		}
+		if reason != "" {
+			return &aclError{Index: i, Cmd: cmd, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// contains ...
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Index     int       `json:"index"`
+	Group     string    `json:"group"`
+	Key       string    `json:"key"`
+	Field     string    `json:"field,omitempty"`
+	From      string    `json:"from"`
+	Reason    string    `json:"reason"`
+}
+
+var audit = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+// OpenAuditLog appends audit entries to the file at path instead of
+// stderr.
+func OpenAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	audit.Lock()
+	defer audit.Unlock()
+	audit.w = f
+	return nil
+}
+
+// auditRejected ...
+func auditRejected(msg *kafka.Message, err *aclError) {
+	entry := AuditEntry{
+		Time:      time.Now(),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Index:     err.Index,
+		Group:     err.Cmd.Group,
+		Key:       err.Cmd.Key,
+		Field:     err.Cmd.Field,
+		From:      err.Cmd.From,
+		Reason:    err.Reason,
+	}
+	b, _ := json.Marshal(entry)
+	audit.Lock()
+	defer audit.Unlock()
+	if _, werr := fmt.Fprintf(audit.w, "%s\n", b); werr != nil {
+		log.Printf("[audit] write error: %v (%s)\n", werr, b)
+	}
+}
+
+// authorize checks the commands of p against the ACL of topic. A rejected
+// message keeps no commands, so applying it only moves the offset past it.
+func (t TopicConfig) authorize(p *pendingMessage) {
+	err := t.ACL.Check(p.cmds)
+	if err == nil {
+		return
+	}
+	countError(p.msg.Topic, STAGE_ACL)
+	auditRejected(p.msg, err.(*aclError))
+	p.cmds = nil
+	p.id = ""
+}
@@ -0,0 +1,41 @@
+package lib
+
+import "testing"
+
+// TestACLCheck ...
+func TestACLCheck(t *testing.T) {
+	acl := &ACLConfig{Groups: []string{"LISTS", "HASHES"}, Keys: []string{"comment:subjectid:*"}, Froms: []string{FROM_SELF, FROM_PREVIOUS_VALUE}}
+	allowed := []Command{
+		{Group: "LISTS", Key: "comment:subjectid:x", From: FROM_SELF},
+		{Group: "HASHES", Key: "comment:subjectid:x", Field: "inverted:comment:y", From: FROM_PREVIOUS_VALUE},
+	}
+	if err := acl.Check(allowed); err != nil {
+		t.Fatal(err)
+	}
+	for cmd, reason := range map[Command]string{
+		{Group: "ZADD", Key: "comment:subjectid:x", From: FROM_SELF}:   "group not allowed",
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF}:         "key not allowed",
+		{Group: "LISTS", Key: "comment:subjectid:x", From: FROM_VALUE}: "from not allowed",
+		{Group: "HASHES", Key: OFFSET_KEY, From: FROM_SELF}:            "reserved key",
+	} {
+		err := acl.Check(append(allowed, cmd))
+		if e, ok := err.(*aclError); !ok || e.Index != 2 || e.Reason != reason {
+			t.Fatalf("%v: got %v, want %s", cmd, err, reason)
+		}
+	}
+	for pattern, keys := range map[string]map[string]bool{
+		"comment:*":     {"comment:subjectid:x": true, "comment:a/b": true, "comment:": true, "subject:x": false},
+		"*:subjectid:?": {"comment:subjectid:x": true, "comment:subjectid:xy": false},
+		"subject":       {"subject": true, "subject:x": false},
+	} {
+		for key, want := range keys {
+			if got := matchGlob(pattern, key); got != want {
+				t.Fatalf("matchGlob(%q, %q) = %v, want %v", pattern, key, got, want)
+			}
+		}
+	}
+	var open *ACLConfig
+	if err := open.Check([]Command{{Group: "LISTS", Key: "applied:x", From: FROM_SELF}}); err == nil {
+		t.Fatal("reserved key accepted without acl")
+	}
+}
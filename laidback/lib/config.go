@@ -1,29 +1,111 @@
 package lib
 
-import "github.com/BurntSushi/toml"
+import (
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yasukun/roure/memkafka"
+	"github.com/yasukun/roure/storage"
+)
 
 type Config struct {
-	Main    MainConfig    `toml:"main"`
-	Kafka   KafkaConfig   `toml:"kafka"`
-	Ledisdb LedisdbConfig `toml:"ledisdb"`
+	Main       MainConfig       `toml:"main"`
+	Supervisor SupervisorConfig `toml:"supervisor"`
+	Kafka      KafkaConfig      `toml:"kafka"`
+	Ledisdb    LedisdbConfig    `toml:"ledisdb"`
+	TTLs       []TTLConfig      `toml:"ttl"`
+	Metrics    MetricsConfig    `toml:"metrics"`
+	Rebuild    RebuildConfig    `toml:"rebuild"`
+	Registry   RegistryConfig   `toml:"registry"`
+	Dedup      DedupConfig      `toml:"dedup"`
+	Scripts    []ScriptConfig   `toml:"script"`
+	Lease      LeaseConfig      `toml:"lease"`
+}
+
+// LeaseConfig lets several instances share one ledis. An instance reads a
+// partition only while it holds the lease of the partition. TTL and Renew
+// are in milliseconds, a TTL of 0 turns leasing off.
+type LeaseConfig struct {
+	TTL   int    `toml:"ttl"`
+	Renew int    `toml:"renew_interval"`
+	Owner string `toml:"owner"`
+}
+
+// ScriptConfig is a named Lua script the SCRIPT command group runs. The
+// script sees the command key as KEYS[1] followed by the keys of all
+// commands of the message, and the value resolved from the command's from
+// as ARGV[1], its score as ARGV[2] and the message as ARGV[3] followed by
+// the raw values of all commands. It may write any key in KEYS. SCRIPT
+// commands take no TTL, [[ttl]] defaults included; a script expires what it
+// writes itself.
+type ScriptConfig struct {
+	Name   string `toml:"name"`
+	Source string `toml:"source"`
+}
+
+// DedupConfig sets how long the event ids of applied messages are kept.
+// A Window of 0 turns deduplication off.
+type DedupConfig struct {
+	Window int    `toml:"window"`
+	Field  string `toml:"field"`
+}
+
+type RegistryConfig struct {
+	URL string `toml:"url"`
+}
+
+type RebuildConfig struct {
+	DB               int  `toml:"db"`
+	Swap             bool `toml:"swap"`
+	ProgressInterval int  `toml:"progress_interval"`
+}
+
+type MetricsConfig struct {
+	Addr        string `toml:"addr"`
+	LagInterval int    `toml:"lag_interval"`
 }
 
 type MainConfig struct {
-	UpdateOffsetWait int  `toml:"update_offset_wait"`
-	Debug            bool `toml:"debug"`
+	UpdateOffsetWait int    `toml:"update_offset_wait"`
+	ShutdownTimeout  int    `toml:"shutdown_timeout"`
+	Debug            bool   `toml:"debug"`
+	AuditLog         string `toml:"audit_log"`
+}
+
+type SupervisorConfig struct {
+	BackoffMin     int `toml:"backoff_min"`
+	BackoffMax     int `toml:"backoff_max"`
+	MaxRestarts    int `toml:"max_restarts"`
+	StatusInterval int `toml:"status_interval"`
 }
 
 type KafkaConfig struct {
-	Topics  []TopicConfig `toml:"topic"`
-	Brokers []Broker      `toml:"broker"`
+	Backend           string        `toml:"backend"`
+	Ack               int           `toml:"ack"`
+	WriteTimeout      int           `toml:"write_timeout"`
+	DiscoveryInterval int           `toml:"discovery_interval"`
+	BatchSize         int           `toml:"batch_size"`
+	FlushInterval     int           `toml:"flush_interval"`
+	GroupID           string        `toml:"group_id"`
+	Topics            []TopicConfig `toml:"topic"`
+	Brokers           []Broker      `toml:"broker"`
 }
 
 type TopicConfig struct {
 	Topic      string `toml:"topic"`
 	AvroSchema string `toml:"avro_schema"`
-	Partitions int    `toml:"partitions"`
-	Minbytes   int    `toml:"minbytes"`
-	Maxbytes   int    `toml:"maxbytes"`
+	// UnframedSchema is the schema of messages written without a registry
+	// schema id, AvroSchema when empty.
+	UnframedSchema string     `toml:"unframed_schema"`
+	Partitions     int        `toml:"partitions"`
+	Minbytes       int        `toml:"minbytes"`
+	Maxbytes       int        `toml:"maxbytes"`
+	DeadLetter     string     `toml:"dead_letter"`
+	ACL            *ACLConfig `toml:"acl"`
+	// EventField names the message field rules match their event against.
+	EventField string       `toml:"event_field"`
+	Rules      []RuleConfig `toml:"rule"`
 }
 
 type Broker struct {
@@ -31,9 +113,31 @@ type Broker struct {
 }
 
 type LedisdbConfig struct {
-	Addr     string `toml:"addr"`
-	Password string `toml:"password"`
-	DB       int    `toml:"db"`
+	Backend   string `toml:"backend"`
+	Addr      string `toml:"addr"`
+	Password  string `toml:"password"`
+	DB        int    `toml:"db"`
+	Dialect   string `toml:"dialect"`
+	Retry     int    `toml:"retry"`
+	RetryWait int    `toml:"retry_wait"`
+	// SnapshotLimit caps the elements of a key copied to revert a failed
+	// message, 0 means DEFAULT_SNAPSHOT_LIMIT.
+	SnapshotLimit int `toml:"snapshot_limit"`
+}
+
+const DEFAULT_SNAPSHOT_LIMIT = 1000
+
+// snapshotLimit ...
+func snapshotLimit(conf Config) int {
+	if conf.Ledisdb.SnapshotLimit > 0 {
+		return conf.Ledisdb.SnapshotLimit
+	}
+	return DEFAULT_SNAPSHOT_LIMIT
+}
+
+type TTLConfig struct {
+	Prefix string `toml:"prefix"`
+	TTL    int64  `toml:"ttl"`
 }
 
 // DecodeConfigToml ...
@@ -43,5 +147,30 @@ func DecodeConfigToml(tomlfile string) (Config, error) {
 	if err != nil {
 		return config, err
 	}
+	if config.Main.ShutdownTimeout == 0 {
+		config.Main.ShutdownTimeout = 10
+	}
+	if config.Kafka.Backend == "" {
+		config.Kafka.Backend = memkafka.BACKEND_KAFKA
+	}
+	if config.Kafka.BatchSize == 0 {
+		config.Kafka.BatchSize = 1
+	}
+	if config.Kafka.FlushInterval == 0 {
+		config.Kafka.FlushInterval = 100
+	}
+	if config.Dedup.Field == "" {
+		config.Dedup.Field = "id"
+	}
+	if config.Lease.Renew == 0 {
+		config.Lease.Renew = config.Lease.TTL / 3
+	}
+	if config.Lease.Owner == "" {
+		host, _ := os.Hostname()
+		config.Lease.Owner = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	if config.Ledisdb.Backend == "" {
+		config.Ledisdb.Backend = storage.BACKEND_REDIS
+	}
 	return config, nil
 }
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/storage"
+)
+
+const (
+	DLQ_TOPIC_HEADER     = "dlq.topic"
+	DLQ_PARTITION_HEADER = "dlq.partition"
+	DLQ_OFFSET_HEADER    = "dlq.offset"
+	DLQ_ERROR_HEADER     = "dlq.error"
+)
+
+// header ...
+func header(msg *kafka.Message, key string) (string, bool) {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+// DeadLetter writes a message that could not be applied to the dead-letter
+// topic of its topic and moves the partition offset past it, fenced by
+// lease when it is not nil. Without a dead-letter topic the cause is
+// returned unchanged.
+func DeadLetter(conf Config, client storage.Store, lease *Lease, topic TopicConfig, msg *kafka.Message, cause error) error {
+	if topic.DeadLetter == "" {
+		return cause
+	}
+	log.Printf("dead letter (topic=%s partition=%d offset=%d): %v\n", msg.Topic, msg.Partition, msg.Offset, cause)
+	dlq := kafka.Message{
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: []kafka.Header{
+			{Key: DLQ_TOPIC_HEADER, Value: []byte(msg.Topic)},
+			{Key: DLQ_PARTITION_HEADER, Value: []byte(strconv.Itoa(msg.Partition))},
+			{Key: DLQ_OFFSET_HEADER, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			{Key: DLQ_ERROR_HEADER, Value: []byte(cause.Error())},
+		},
+	}
+	if err := produceMsg(conf, topic.DeadLetter, &dlq); err != nil {
+		countError(msg.Topic, STAGE_DEAD_LETTER)
+		return fmt.Errorf("produce dead letter error (%v): %v", cause, err)
+	}
+	if err := setLeasedOffset(client, lease, msg.Topic, msg.Partition, msg.Offset+1); err != nil {
+		countError(msg.Topic, STAGE_OFFSET)
+		return err
+	}
+	return nil
+}
+
+// ReplayDeadLetter re-injects the dead letters of topic into their original
+// topic. Progress is kept in the offset hash so a message is replayed once.
+// With leasing on each dead-letter partition is leased while it is
+// replayed, so concurrent replays do not move its offset back.
+func ReplayDeadLetter(ctx context.Context, conf Config, client storage.Store, topic TopicConfig) (int, error) {
+	replayed := 0
+	partitions, err := Partitions(conf, topic.DeadLetter)
+	if err != nil {
+		return replayed, err
+	}
+	for _, partition := range partitions {
+		if err := SetOffsetNX(client, topic.DeadLetter, partition); err != nil {
+			return replayed, err
+		}
+		offset, err := Offset(client, topic.DeadLetter, partition)
+		if err != nil {
+			return replayed, err
+		}
+		last, err := LastOffset(ctx, conf, topic.DeadLetter, partition)
+		if err != nil {
+			return replayed, err
+		}
+		if offset >= last {
+			continue
+		}
+		n, err := replayLeased(ctx, conf, client, topic, partition, offset, last)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// replayLeased replays one dead-letter partition, holding its lease while
+// it does when leasing is on.
+func replayLeased(ctx context.Context, conf Config, client storage.Store, topic TopicConfig, partition int, offset, last int64) (int, error) {
+	if conf.Lease.TTL <= 0 {
+		return replayPartition(ctx, conf, client, nil, topic, partition, offset, last)
+	}
+	lease, err := AcquireLease(ctx, conf, client, topic.DeadLetter, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer lease.Release(client)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go lease.Keep(ctx, conf, client, cancel)
+	// the last holder may have moved the offset while this one waited
+	if offset, err = Offset(client, topic.DeadLetter, partition); err != nil {
+		return 0, err
+	}
+	return replayPartition(ctx, conf, client, lease, topic, partition, offset, last)
+}
+
+// replayPartition ...
+func replayPartition(ctx context.Context, conf Config, client storage.Store, lease *Lease, topic TopicConfig, partition int, offset, last int64) (int, error) {
+	replayed := 0
+	r := partitionReader(conf, topic, topic.DeadLetter, partition)
+	defer r.Close()
+	r.SetOffset(offset)
+
+	for offset < last {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return replayed, err
+		}
+		original, ok := header(&m, DLQ_TOPIC_HEADER)
+		if !ok {
+			original = topic.Topic
+		}
+		if conf.Main.Debug {
+			cause, _ := header(&m, DLQ_ERROR_HEADER)
+			log.Printf("[dlq] replay offset %d to %s (cause: %s)\n", m.Offset, original, cause)
+		}
+		if err := produceMsg(conf, original, &kafka.Message{Key: m.Key, Value: m.Value}); err != nil {
+			return replayed, fmt.Errorf("replay dead letter error (offset=%d): %v", m.Offset, err)
+		}
+		offset = m.Offset + 1
+		if err := setLeasedOffset(client, lease, topic.DeadLetter, partition, offset); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type StartFunc func(ctx context.Context, topic TopicConfig, partition int)
+
+// SyncPartitions starts a reader for every partition the brokers report for
+// the configured topics that is not supervised yet. When the brokers cannot
+// be asked and fallback is set, the configured partition count is used.
+func SyncPartitions(ctx context.Context, conf Config, supervisor *Supervisor, fallback bool, start StartFunc) {
+	for _, topic := range conf.Kafka.Topics {
+		partitions, err := Partitions(conf, topic.Topic)
+		if err != nil {
+			log.Printf("[discovery] %v\n", err)
+			if !fallback {
+				continue
+			}
+			partitions = []int{}
+			for i := 0; i < topic.Partitions; i++ {
+				partitions = append(partitions, i)
+			}
+		} else if len(partitions) != topic.Partitions {
+			log.Printf("[discovery] warning: %s has %d partitions on the brokers, %d in config\n", topic.Topic, len(partitions), topic.Partitions)
+		}
+		for _, partition := range partitions {
+			if supervisor.Has(topic.Topic, partition) {
+				continue
+			}
+			start(ctx, topic, partition)
+		}
+	}
+}
+
+// WatchPartitions calls SyncPartitions every interval until ctx is done.
+func WatchPartitions(ctx context.Context, conf Config, supervisor *Supervisor, interval time.Duration, start StartFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			SyncPartitions(ctx, conf, supervisor, false, start)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
+)
+
+// Write is what one command of a message would do to ledis. Result is what
+// the command would return, the value later commands get through
+// PREVIOUS_VALUE or RESULT. A value that cannot be known before the message
+// is applied is left empty and Unresolved says why.
+type Write struct {
+	Index      int     `json:"index"`
+	Group      string  `json:"group"`
+	Key        string  `json:"key"`
+	Field      string  `json:"field,omitempty"`
+	From       string  `json:"from"`
+	Value      string  `json:"value"`
+	Unresolved string  `json:"unresolved,omitempty"`
+	Previous   int     `json:"previous,omitempty"`
+	As         string  `json:"as,omitempty"`
+	Score      float64 `json:"score"`
+	TTL        int64   `json:"ttl,omitempty"`
+	Expire     string  `json:"expire,omitempty"`
+	Result     string  `json:"result,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Explanation is the decoded form of one message. A message the topic ACL
+// rejects has no writes and says why in Rejected.
+type Explanation struct {
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Commands  []Command `json:"commands"`
+	Writes    []Write   `json:"writes"`
+	Rejected  string    `json:"rejected,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// explainResult is the predicted result of one command, or why it is not
+// known.
+type explainResult struct {
+	value      string
+	unresolved string
+}
+
+// resolver predicts command results with read-only lookups in ledis. What
+// an earlier command of the message wrote, other than by appending to a
+// list, is not predicted. Writes are tracked per type, LedisDB keeps a
+// keyspace per type, and per hash field or member, and groups that may
+// write any type block the key for all of them.
+type resolver struct {
+	client  storage.Store
+	pushes  map[string]int64
+	written map[string]int
+}
+
+// resolvedTypes is the data type each builtin group reads and writes.
+var resolvedTypes = map[string]string{
+	"LISTS":   TYPE_LIST,
+	"LREM":    TYPE_LIST,
+	"HASHES":  TYPE_HASH,
+	"HDEL":    TYPE_HASH,
+	"SETS":    TYPE_KV,
+	"ZADD":    TYPE_ZSET,
+	"ZINCRBY": TYPE_ZSET,
+	"ZREM":    TYPE_ZSET,
+	"SREM":    TYPE_SET,
+}
+
+// result predicts what cmd returns when value is its resolved value.
+func (r *resolver) result(cmd Command, value string) explainResult {
+	typ, ok := resolvedTypes[cmd.Group]
+	if !ok {
+		return explainResult{unresolved: fmt.Sprintf("%s results are only known once it runs", cmd.Group)}
+	}
+	if r.client == nil {
+		return explainResult{unresolved: "ledis was not read"}
+	}
+	for _, k := range []string{"*:" + cmd.Key, writeSlot(cmd, typ, value)} {
+		if index, ok := r.written[k]; ok {
+			return explainResult{unresolved: fmt.Sprintf("#%d writes %s first", index, cmd.Key)}
+		}
+	}
+	if cmd.Group == "LREM" && r.pushes[cmd.Key] > 0 {
+		return explainResult{unresolved: fmt.Sprintf("%s is appended to first", cmd.Key)}
+	}
+	var result string
+	var err error
+	switch cmd.Group {
+	case "LISTS":
+		var n int64
+		if n, err = r.client.LLen(cmd.Key); err == nil {
+			result = strconv.FormatInt(n+r.pushes[cmd.Key]+1, 10)
+		}
+	case "HASHES":
+		var exists bool
+		if exists, err = r.client.HExists(cmd.Key, cmd.Field); err == nil {
+			result = boolResult(!exists)
+		}
+	case "HDEL":
+		var exists bool
+		if exists, err = r.client.HExists(cmd.Key, cmd.Field); err == nil {
+			result = boolResult(exists)
+		}
+	case "SETS":
+		result = "OK"
+	case "LREM":
+		var items []string
+		if items, err = r.client.LRange(cmd.Key, 0, -1); err == nil {
+			n := 0
+			for _, item := range items {
+				if item == value {
+					n++
+				}
+			}
+			result = strconv.Itoa(n)
+		}
+	case "ZADD", "ZINCRBY", "ZREM":
+		var members []storage.Z
+		if members, err = r.client.ZRangeWithScores(cmd.Key, 0, -1); err == nil {
+			found, score := false, 0.0
+			for _, z := range members {
+				if z.Member == value {
+					found, score = true, z.Score
+				}
+			}
+			switch cmd.Group {
+			case "ZADD":
+				result = boolResult(!found)
+			case "ZREM":
+				result = boolResult(found)
+			default:
+				result = strconv.FormatFloat(score+cmd.Score, 'f', -1, 64)
+			}
+		}
+	case "SREM":
+		return explainResult{unresolved: "set membership is not read"}
+	}
+	if err != nil {
+		return explainResult{unresolved: fmt.Sprintf("read error: %v", err)}
+	}
+	return explainResult{value: result}
+}
+
+// boolResult is the integer reply of a command that reports whether it
+// changed anything.
+func boolResult(changed bool) string {
+	if changed {
+		return "1"
+	}
+	return "0"
+}
+
+// writeSlot names the part of ledis cmd writes.
+func writeSlot(cmd Command, typ, value string) string {
+	switch typ {
+	case TYPE_HASH:
+		return typ + ":" + cmd.Key + ":" + cmd.Field
+	case TYPE_ZSET, TYPE_SET:
+		return typ + ":" + cmd.Key + ":" + value
+	}
+	return typ + ":" + cmd.Key
+}
+
+// record notes that cmd, the index-th command, wrote with value.
+func (r *resolver) record(cmd Command, index int, value explainResult) {
+	typ, ok := resolvedTypes[cmd.Group]
+	switch {
+	case !ok:
+		r.written["*:"+cmd.Key] = index
+	case cmd.Group == "LISTS":
+		r.pushes[cmd.Key]++
+	case value.unresolved != "" && typ != TYPE_HASH:
+		// the member is not known, any of them may have changed
+		r.written["*:"+cmd.Key] = index
+	default:
+		r.written[writeSlot(cmd, typ, value.value)] = index
+	}
+}
+
+// ExplainCmds resolves cmds the way the apply script would. The results
+// PREVIOUS_VALUE and RESULT refer to are predicted with read-only lookups
+// in client, which may be nil to not read ledis at all. A value whose
+// result cannot be predicted is reported as unresolved, with the reason.
+func ExplainCmds(conf Config, client storage.Store, cmds []Command, msg *kafka.Message) []Write {
+	writes := []Write{}
+	r := &resolver{client: client, pushes: map[string]int64{}, written: map[string]int{}}
+	results := []explainResult{}
+	named := map[string]int{}
+	for i, cmd := range cmds {
+		w := Write{
+			Index: i + 1,
+			Group: cmd.Group,
+			Key:   cmd.Key,
+			Field: cmd.Field,
+			From:  cmd.From,
+			Value: cmd.Value,
+			Score: cmd.Score,
+			TTL:   commandTTL(conf, &cmd),
+			As:    cmd.As,
+		}
+		value := explainResult{value: cmd.Value}
+		switch cmd.From {
+		case FROM_SELF:
+			value.value = string(msg.Value)
+			w.Value = fmt.Sprintf("<message %d bytes>", len(msg.Value))
+		case FROM_PREVIOUS_VALUE:
+			value = explainResult{}
+			if i > 0 {
+				w.Previous = i
+				value = results[i-1]
+			}
+			w.Value = value.value
+		case FROM_RESULT:
+			value = explainResult{}
+			if index, ok := named[cmd.Value]; ok {
+				w.Previous = index
+				value = results[index-1]
+			}
+			w.Value = value.value
+		}
+		if value.unresolved != "" {
+			w.Unresolved = fmt.Sprintf("result of #%d: %s", w.Previous, value.unresolved)
+		}
+		if cmd.As != "" {
+			named[cmd.As] = i + 1
+		}
+		if err := ValidateCommand(&cmd); err != nil {
+			w.Error = err.Error()
+		} else if cmd.From == FROM_RESULT && w.Previous == 0 {
+			w.Error = fmt.Sprintf("unknown result %q", cmd.Value)
+		} else if group, _ := LookupGroup(cmd.Group); w.TTL > 0 {
+			w.Expire = expireCommand(conf, group.Type)
+		}
+		result := explainResult{unresolved: "its value is unresolved"}
+		if w.Error != "" {
+			result.unresolved = "it fails"
+		} else if w.Unresolved == "" {
+			result = r.result(cmd, value.value)
+		}
+		w.Result = result.value
+		r.record(cmd, i+1, value)
+		results = append(results, result)
+		writes = append(writes, w)
+	}
+	return writes
+}
+
+// Explain decodes msg and resolves its commands, reading ledis through
+// client when it is not nil.
+func Explain(conf Config, client storage.Store, codec *avroreg.Codec, msg *kafka.Message) Explanation {
+	topic := topicConfig(conf, msg.Topic)
+	p, err := extractMessage(conf, topic, codec, msg)
+	if err != nil {
+		e := Explanation{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
+		e.Error = fmt.Sprintf("decode error: %v", err)
+		return e
+	}
+	return explainMessage(conf, client, topic, p)
+}
+
+// explainMessage resolves the commands of a decoded message after checking
+// them against the ACL of topic, like the projector does. The rejection is
+// not audited.
+func explainMessage(conf Config, client storage.Store, topic TopicConfig, p pendingMessage) Explanation {
+	e := Explanation{Topic: p.msg.Topic, Partition: p.msg.Partition, Offset: p.msg.Offset, Commands: p.cmds}
+	if err := topic.ACL.Check(p.cmds); err != nil {
+		e.Rejected = err.Error()
+		e.Writes = []Write{}
+		return e
+	}
+	e.Writes = ExplainCmds(conf, client, p.cmds, p.msg)
+	return e
+}
+
+// Print writes e in a human readable form.
+func (e Explanation) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s offset %d\n", offsetField(e.Topic, e.Partition), e.Offset)
+	if e.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", e.Error)
+		return
+	}
+	if e.Rejected != "" {
+		fmt.Fprintf(w, "  rejected by acl: %s\n  nothing is written, the offset moves past it\n", e.Rejected)
+		return
+	}
+	if len(e.Writes) == 0 {
+		fmt.Fprint(w, "  no commands\n")
+	}
+	for _, write := range e.Writes {
+		fmt.Fprintf(w, "  #%d %s %s", write.Index, write.Group, write.Key)
+		if write.Field != "" {
+			fmt.Fprintf(w, " field=%s", write.Field)
+		}
+		value := write.Value
+		if write.Unresolved != "" {
+			value = fmt.Sprintf("<unresolved, %s>", write.Unresolved)
+		}
+		fmt.Fprintf(w, " value=%s (from %s) score=%v", value, write.From, write.Score)
+		if write.As != "" {
+			fmt.Fprintf(w, " as=%s", write.As)
+		}
+		if write.TTL > 0 {
+			fmt.Fprintf(w, " ttl=%d (%s)", write.TTL, write.Expire)
+		}
+		if write.Result != "" {
+			fmt.Fprintf(w, " -> %s", write.Result)
+		}
+		fmt.Fprint(w, "\n")
+		if write.Error != "" {
+			fmt.Fprintf(w, "     error: %s\n", write.Error)
+		}
+	}
+}
+
+// ExplainOptions ...
+type ExplainOptions struct {
+	Partitions []int
+	Offset     int64
+	Count      int
+	JSON       bool
+}
+
+// ExplainTopic reads topic from opts.Offset and writes an explanation of
+// every message to out. It stops after opts.Count messages per partition,
+// or follows the topic when Count is 0. Results are predicted from client,
+// which may be nil.
+func ExplainTopic(ctx context.Context, conf Config, client storage.Store, codec *avroreg.Codec, topic TopicConfig, opts ExplainOptions, out io.Writer) error {
+	partitions := opts.Partitions
+	if len(partitions) == 0 {
+		var err error
+		partitions, err = Partitions(conf, topic.Topic)
+		if err != nil {
+			return err
+		}
+	}
+	mu := &sync.Mutex{}
+	enc := json.NewEncoder(out)
+	errs := make(chan error, len(partitions))
+	for _, partition := range partitions {
+		go func(partition int) {
+			r := partitionReader(conf, topic, topic.Topic, partition)
+			defer r.Close()
+			r.SetOffset(opts.Offset)
+			for n := 0; opts.Count == 0 || n < opts.Count; n++ {
+				m, err := r.ReadMessage(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				e := Explain(conf, client, codec, &m)
+				mu.Lock()
+				if opts.JSON {
+					err = enc.Encode(e)
+				} else {
+					e.Print(out)
+				}
+				mu.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(partition)
+	}
+	var err error
+	for range partitions {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/storage"
+)
+
+// TestExplainCmds ...
+func TestExplainCmds(t *testing.T) {
+	conf := Config{TTLs: []TTLConfig{{Prefix: "subject:", TTL: 60}}}
+	cmds := []Command{
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF, Score: 1},
+		{Group: "HASHES", Key: "subject:news", Field: "invert_idx:1", From: FROM_PREVIOUS_VALUE, Score: 1},
+		{Group: "UNKNOWN", Key: "x", From: FROM_VALUE, Value: "v"},
+	}
+	msg := &kafka.Message{Value: []byte("abc")}
+	writes := ExplainCmds(conf, nil, cmds, msg)
+	if len(writes) != 3 {
+		t.Fatalf("writes %d, want 3", len(writes))
+	}
+	if writes[0].Value != "<message 3 bytes>" || writes[0].TTL != 60 || writes[0].Expire != "LEXPIRE" {
+		t.Fatalf("unexpected write %+v", writes[0])
+	}
+	if writes[1].Previous != 1 || writes[1].Expire != "HEXPIRE" || writes[1].Unresolved != "result of #1: ledis was not read" {
+		t.Fatalf("unexpected write %+v", writes[1])
+	}
+	if writes[2].Error == "" {
+		t.Fatal("unknown group not reported")
+	}
+
+	// results are predicted from ledis and the earlier commands
+	client := storage.NewMemory("TestExplainCmds", 0)
+	if err := client.HSet("subject:news", "invert_idx:1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	cmds = []Command{
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF, As: "pos"},
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF},
+		{Group: "HASHES", Key: "subject:news", Field: "invert_idx:1", From: FROM_PREVIOUS_VALUE},
+		{Group: "HASHES", Key: "subject:news", Field: "invert_idx:2", From: FROM_RESULT, Value: "pos"},
+		{Group: GROUP_SCRIPT, Key: "subject:news", Field: "x", From: FROM_VALUE},
+		{Group: "SETS", Key: "subject:title", From: FROM_PREVIOUS_VALUE},
+	}
+	writes = ExplainCmds(conf, client, cmds, msg)
+	for i, want := range []string{"1", "2", "0", "1"} {
+		if writes[i].Result != want {
+			t.Fatalf("write %d result %q, want %s", i+1, writes[i].Result, want)
+		}
+	}
+	if writes[2].Value != "2" || writes[3].Value != "1" {
+		t.Fatalf("unexpected values %q %q", writes[2].Value, writes[3].Value)
+	}
+	if writes[5].Value != "" || writes[5].Unresolved == "" {
+		t.Fatalf("script result resolved: %+v", writes[5])
+	}
+}
+
+// TestExplainRejected ...
+func TestExplainRejected(t *testing.T) {
+	conf, err := DecodeConfigToml("../laidback.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := topicConfig(conf, "roure.avro.subject")
+	cmds := []Command{
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF},
+		{Group: "SETS", Key: "subject:news:title", From: FROM_VALUE, Value: "x"},
+	}
+	p := pendingMessage{msg: &kafka.Message{Topic: topic.Topic, Offset: 7}, cmds: cmds}
+	e := explainMessage(conf, nil, topic, p)
+	if !strings.Contains(e.Rejected, "group not allowed") || len(e.Writes) != 0 || len(e.Commands) != 2 {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	var out bytes.Buffer
+	e.Print(&out)
+	if !strings.Contains(out.String(), "rejected by acl: command 1 (SETS subject:news:title) rejected: group not allowed") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	p.cmds = cmds[:1]
+	if e := explainMessage(conf, nil, topic, p); e.Rejected != "" || len(e.Writes) != 1 {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+}
@@ -2,11 +2,15 @@ package lib
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
 
-	"github.com/go-redis/redis"
-	"github.com/linkedin/goavro"
 	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/memkafka"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
 )
 
 type Command struct {
@@ -15,84 +19,454 @@ type Command struct {
 	Field string
 	From  string
 	Value string
+	TTL   int64
+	Score float64
+	As    string
+}
+
+// numeric ...
+func numeric(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// commandScore takes the score from the message field named by score_from,
+// otherwise from score. Commands written before scores existed keep the old
+// fixed score of 1.
+func commandScore(record map[string]interface{}, field map[string]interface{}) (float64, error) {
+	if from, ok := field["score_from"].(string); ok && from != "" {
+		score, ok := numeric(record[from])
+		if !ok {
+			return 0, fmt.Errorf("score field %s is not numeric", from)
+		}
+		return score, nil
+	}
+	if score, ok := field["score"].(float64); ok {
+		return score, nil
+	}
+	return 1, nil
 }
 
 // ledisCmds ...
-func ledisCmds(native *interface{}) []Command {
+func ledisCmds(native *interface{}) ([]Command, error) {
 	// native data example:
 	// map[redis:[map[value:test value group:LISTS key:sumbject:new field:] map[key:subject:new field:invert_idx:bcab4l2k2jbda3lsf41g value:1 group:HASHES]]]
 
 	cmds := []Command{}
+	record := (*native).(map[string]interface{})
 	var fields []interface{}
-	if v, ok := (*native).(map[string]interface{})["redis"]; ok {
+	if v, ok := record["redis"]; ok {
 		fields = v.([]interface{})
 	} else {
 		// commad not exists
-		return cmds
+		return cmds, nil
 	}
 
 	for _, field := range fields {
+		// ttl, score and as are optional in older schemas
+		ttl, _ := field.(map[string]interface{})["ttl"].(int64)
+		as, _ := field.(map[string]interface{})["as"].(string)
+		score, err := commandScore(record, field.(map[string]interface{}))
+		if err != nil {
+			return cmds, err
+		}
 
-		cmds = append(cmds, Command{
+		cmd := Command{
 			Group: field.(map[string]interface{})["group"].(string),
 			Key:   field.(map[string]interface{})["key"].(string),
 			Field: field.(map[string]interface{})["field"].(string),
 			From:  field.(map[string]interface{})["from"].(string),
 			Value: field.(map[string]interface{})["value"].(string),
-		})
+			TTL:   ttl,
+			Score: score,
+			As:    as,
+		}
+		for _, s := range []*string{&cmd.Key, &cmd.Field, &cmd.Value} {
+			if *s, err = resolveTemplate(*s, record); err != nil {
+				return cmds, err
+			}
+		}
+		cmds = append(cmds, cmd)
 	}
-	return cmds
+	return cmds, nil
 }
 
 // CommandExtraction ...
-func CommandExtraction(codec *goavro.Codec, msg *kafka.Message) (cmds []Command, err error) {
+func CommandExtraction(codec *avroreg.Codec, msg *kafka.Message) (cmds []Command, err error) {
 	native, _, err := codec.NativeFromBinary(msg.Value)
 	if err != nil {
 		return
 	}
 
-	cmds = ledisCmds(&native)
+	cmds, err = ledisCmds(&native)
 	return
 }
 
-// ReadKafka ...
-func ReadKafka(ctx context.Context, conf Config, client *redis.Client, codec *goavro.Codec, topic TopicConfig, partition int) error {
+// extractMessage decodes msg into its commands and the event id named by
+// the dedup field. Messages without commands get the ones of the topic
+// rules.
+func extractMessage(conf Config, topic TopicConfig, codec *avroreg.Codec, msg *kafka.Message) (pendingMessage, error) {
+	p := pendingMessage{msg: msg}
+	native, _, err := codec.NativeFromBinary(msg.Value)
+	if err != nil {
+		return p, err
+	}
+	if p.cmds, err = ledisCmds(&native); err != nil {
+		return p, err
+	}
+	record, ok := native.(map[string]interface{})
+	if ok && len(p.cmds) == 0 && len(topic.Rules) > 0 {
+		if p.cmds, err = topic.ruleCmds(record); err != nil {
+			return p, err
+		}
+	}
+	if ok && conf.Dedup.Window > 0 {
+		if v, ok := recordField(record, conf.Dedup.Field); ok {
+			p.id, _ = templateValue(v)
+		}
+	}
+	return p, nil
+}
+
+// topicConfig returns the configuration of the topic called name.
+func topicConfig(conf Config, name string) TopicConfig {
+	for _, topic := range conf.Kafka.Topics {
+		if topic.Topic == name {
+			return topic
+		}
+	}
+	return TopicConfig{Topic: name}
+}
+
+// brokerAddrs ...
+func brokerAddrs(conf Config) []string {
 	brokers := []string{}
 	for _, broker := range conf.Kafka.Brokers {
 		brokers = append(brokers, broker.Addr)
 	}
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   brokers,
-		Topic:     topic.Topic,
+	return brokers
+}
+
+// memoryBroker returns the in-process broker named after the first broker
+// address and creates the configured topics on it.
+func memoryBroker(conf Config) *memkafka.Broker {
+	name := ""
+	if addrs := brokerAddrs(conf); len(addrs) > 0 {
+		name = addrs[0]
+	}
+	b := memkafka.Named(name)
+	for _, topic := range conf.Kafka.Topics {
+		b.CreateTopic(topic.Topic, topic.Partitions)
+		if topic.DeadLetter != "" {
+			b.CreateTopic(topic.DeadLetter, topic.Partitions)
+		}
+	}
+	return b
+}
+
+// messageReader is the part of kafka.Reader used to read one partition.
+type messageReader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	SetOffset(offset int64) error
+	Close() error
+}
+
+// partitionReader reads partition of the topic called name with the
+// settings of topic.
+func partitionReader(conf Config, topic TopicConfig, name string, partition int) messageReader {
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		return memoryBroker(conf).NewReader(name, partition)
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokerAddrs(conf),
+		Topic:     name,
 		Partition: partition,
 		MinBytes:  topic.Minbytes,
 		MaxBytes:  topic.Maxbytes,
 	})
+}
+
+// produceMsg ...
+func produceMsg(conf Config, topic string, msg *kafka.Message) error {
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		return memoryBroker(conf).WriteMessages(topic, *msg)
+	}
+	w := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:      brokerAddrs(conf),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: conf.Kafka.Ack,
+		WriteTimeout: time.Duration(conf.Kafka.WriteTimeout) * time.Second,
+	})
+	defer w.Close()
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Kafka.WriteTimeout)*time.Second)
+	defer cancel()
+	if err := w.WriteMessages(ctx, *msg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Partitions ...
+func Partitions(conf Config, topic string) ([]int, error) {
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		return memoryBroker(conf).Partitions(topic)
+	}
+	var err error
+	for _, addr := range brokerAddrs(conf) {
+		var conn *kafka.Conn
+		conn, err = kafka.Dial("tcp", addr)
+		if err != nil {
+			continue
+		}
+		var partitions []kafka.Partition
+		partitions, err = conn.ReadPartitions(topic)
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		ids := []int{}
+		for _, partition := range partitions {
+			ids = append(ids, partition.ID)
+		}
+		return ids, nil
+	}
+	if err == nil {
+		err = errors.New("no broker configured")
+	}
+	return nil, fmt.Errorf("read partitions error (topic=%s): %v", topic, err)
+}
+
+// LastOffset ...
+func LastOffset(ctx context.Context, conf Config, topic string, partition int) (int64, error) {
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		return memoryBroker(conf).LastOffset(topic, partition)
+	}
+	var err error
+	for _, addr := range brokerAddrs(conf) {
+		var conn *kafka.Conn
+		conn, err = kafka.DialLeader(ctx, "tcp", addr, topic, partition)
+		if err != nil {
+			continue
+		}
+		var offset int64
+		offset, err = conn.ReadLastOffset()
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		return offset, nil
+	}
+	if err == nil {
+		err = errors.New("no broker configured")
+	}
+	return -1, fmt.Errorf("read last offset error (topic=%s partition=%d): %v", topic, partition, err)
+}
+
+// applyMessage decodes and applies one message, sending it to the
+// dead-letter topic when it cannot be applied.
+func applyMessage(conf Config, client storage.Store, codec *avroreg.Codec, topic TopicConfig, m *kafka.Message) error {
+	messagesConsumed.WithLabelValues(m.Topic, strconv.Itoa(m.Partition)).Inc()
+	p, err := extractMessage(conf, topic, codec, m)
+	if err != nil {
+		countError(m.Topic, STAGE_DECODE)
+		return DeadLetter(conf, client, nil, topic, m, fmt.Errorf("decode error: %v", err))
+	}
+	topic.authorize(&p)
+	return executeMessage(conf, client, nil, topic, p)
+}
+
+// executeMessage applies one decoded message, sending it to the
+// dead-letter topic when it cannot be applied.
+func executeMessage(conf Config, client storage.Store, lease *Lease, topic TopicConfig, p pendingMessage) error {
+	started := time.Now()
+	err := executeLeased(conf, client, lease, []pendingMessage{p})
+	applyLatency.WithLabelValues(p.msg.Topic).Observe(time.Since(started).Seconds())
+	if err != nil {
+		countError(p.msg.Topic, STAGE_EXECUTE)
+		if isTransient(err) || isLeaseLost(err) {
+			return err
+		}
+		return DeadLetter(conf, client, lease, topic, p.msg, err)
+	}
+	return nil
+}
+
+// applyPending applies decoded messages of one partition with one script
+// call. When a message fails, the messages before it are applied and it
+// left nothing behind, so it is dead-lettered without running it again and
+// the rest are applied after it.
+func applyPending(conf Config, client storage.Store, lease *Lease, topic TopicConfig, pending []pendingMessage) error {
+	for len(pending) > 0 {
+		started := time.Now()
+		err := executeLeased(conf, client, lease, pending)
+		applyBatchLatency.WithLabelValues(topic.Topic).Observe(time.Since(started).Seconds())
+		if err == nil {
+			return nil
+		}
+		countError(topic.Topic, STAGE_EXECUTE)
+		if isTransient(err) || isLeaseLost(err) {
+			return err
+		}
+		failed := 0
+		if e, ok := err.(*applyError); ok {
+			for i, p := range pending {
+				if p.msg.Offset == e.Offset {
+					failed = i
+				}
+			}
+		}
+		if err := DeadLetter(conf, client, lease, topic, pending[failed].msg, err); err != nil {
+			return err
+		}
+		pending = pending[failed+1:]
+	}
+	return nil
+}
+
+// applyBatch decodes and applies messages of one partition. A message that
+// fails to decode is sent to the dead-letter topic after the messages before
+// it are applied. Writes are fenced by lease when it is not nil.
+func applyBatch(conf Config, client storage.Store, lease *Lease, codec *avroreg.Codec, topic TopicConfig, batch []kafka.Message) error {
+	pending := []pendingMessage{}
+	flush := func() error {
+		err := applyPending(conf, client, lease, topic, pending)
+		pending = pending[:0]
+		return err
+	}
+	for i := range batch {
+		m := &batch[i]
+		messagesConsumed.WithLabelValues(m.Topic, strconv.Itoa(m.Partition)).Inc()
+		p, err := extractMessage(conf, topic, codec, m)
+		if err != nil {
+			countError(m.Topic, STAGE_DECODE)
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := DeadLetter(conf, client, lease, topic, m, fmt.Errorf("decode error: %v", err)); err != nil {
+				return err
+			}
+			continue
+		}
+		topic.authorize(&p)
+		pending = append(pending, p)
+	}
+	return flush()
+}
+
+// readBatch blocks for one message and then reads until the batch is full
+// or the flush interval has passed.
+func readBatch(ctx context.Context, conf Config, r messageReader) ([]kafka.Message, error) {
+	m, err := r.ReadMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := []kafka.Message{m}
+	if conf.Kafka.BatchSize <= 1 {
+		return batch, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Kafka.FlushInterval)*time.Millisecond)
+	defer cancel()
+	for len(batch) < conf.Kafka.BatchSize {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			// flush what was read, a cancelled ctx ends the next read
+			break
+		}
+		batch = append(batch, m)
+	}
+	return batch, nil
+}
+
+// ReadKafka reads one partition. With leasing on it first waits for the
+// lease of the partition and stops when the lease is lost.
+func ReadKafka(ctx context.Context, conf Config, client storage.Store, codec *avroreg.Codec, topic TopicConfig, partition int) error {
+	var lease *Lease
+	if conf.Lease.TTL > 0 {
+		var err error
+		if lease, err = AcquireLease(ctx, conf, client, topic.Topic, partition); err != nil {
+			return err
+		}
+		defer lease.Release(client)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go lease.Keep(ctx, conf, client, cancel)
+	}
+
+	r := partitionReader(conf, topic, topic.Topic, partition)
 	defer r.Close()
 
 	offset, err := Offset(client, topic.Topic, partition)
 	if err != nil {
+		countError(topic.Topic, STAGE_OFFSET)
 		return err
 	}
 	r.SetOffset(offset)
 
 	for {
-		m, err := r.ReadMessage(ctx)
+		batch, err := readBatch(ctx, conf, r)
 		if err != nil {
+			if lease != nil && lease.Err() != nil {
+				return lease.Err()
+			}
 			return err
 		}
 
-		if err = SetOffset(client, topic.Topic, partition, m.Offset+1); err != nil {
-			log.Println("update offset error: ", err)
+		if err = applyBatch(conf, client, lease, codec, topic, batch); err != nil {
+			return err
 		}
-		cmds, err := CommandExtraction(codec, &m)
+	}
+}
+
+// commitMessage ...
+func commitMessage(conf Config, r *kafka.Reader, m kafka.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Kafka.WriteTimeout)*time.Second)
+	defer cancel()
+	return r.CommitMessages(ctx, m)
+}
+
+// ReadKafkaGroup consumes topic as a member of the configured consumer
+// group and commits each message to Kafka once it has been applied. The
+// ledis offset hash is still written and keeps messages redelivered after a
+// rebalance from being applied twice.
+func ReadKafkaGroup(ctx context.Context, conf Config, client storage.Store, codec *avroreg.Codec, topic TopicConfig) error {
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		return errors.New("consumer groups need the kafka backend")
+	}
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  brokerAddrs(conf),
+		GroupID:  conf.Kafka.GroupID,
+		Topic:    topic.Topic,
+		MinBytes: topic.Minbytes,
+		MaxBytes: topic.Maxbytes,
+	})
+	defer r.Close()
+
+	for {
+		m, err := r.FetchMessage(ctx)
 		if err != nil {
 			return err
 		}
 
-		if err = ExecuteLedisCmds(conf, client, &cmds, &m); err != nil {
+		if err = applyMessage(conf, client, codec, topic, &m); err != nil {
 			return err
 		}
+
+		// commit even when ctx was cancelled while the message was applied
+		if err = commitMessage(conf, r, m); err != nil {
+			countError(m.Topic, STAGE_OFFSET)
+			return fmt.Errorf("commit offset error (partition=%d offset=%d): %v", m.Partition, m.Offset, err)
+		}
 	}
-	return nil
 }
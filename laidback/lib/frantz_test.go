@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/memkafka"
+	"github.com/yasukun/roure/storage"
+)
+
+// TestCommandScore ...
+func TestCommandScore(t *testing.T) {
+	record := map[string]interface{}{"uts": int64(1527209139), "name": "774"}
+	cases := []struct {
+		field map[string]interface{}
+		score float64
+	}{
+		{map[string]interface{}{}, 1},
+		{map[string]interface{}{"score": float64(2.5), "score_from": ""}, 2.5},
+		{map[string]interface{}{"score": float64(1), "score_from": "uts"}, 1527209139},
+	}
+	for _, c := range cases {
+		score, err := commandScore(record, c.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score != c.score {
+			t.Fatalf("score %v, want %v", score, c.score)
+		}
+	}
+	if _, err := commandScore(record, map[string]interface{}{"score_from": "name"}); err == nil {
+		t.Fatal("non numeric score field accepted")
+	}
+}
+
+// TestResolveTemplate ...
+func TestResolveTemplate(t *testing.T) {
+	record := map[string]interface{}{
+		"id":        "bcab4l2k2jbda3lsf41g",
+		"category":  "news",
+		"uts":       int64(1527209139),
+		"opengraph": map[string]interface{}{"sitename": "site", "url": "http://newssite.com"},
+		"replyid":   map[string]interface{}{"string": "c0ffee"},
+	}
+	cases := []struct {
+		template string
+		want     string
+	}{
+		{"subject:{category}", "subject:news"},
+		{"inverted:comment:{id}", "inverted:comment:bcab4l2k2jbda3lsf41g"},
+		{"{category}:{uts}", "news:1527209139"},
+		{"og:{opengraph.sitename}", "og:site"},
+		{"reply:{replyid}", "reply:c0ffee"},
+		{"plain", "plain"},
+		{`{"json": 1}`, `{"json": 1}`},
+	}
+	for _, c := range cases {
+		got, err := resolveTemplate(c.template, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Fatalf("%s resolved to %s, want %s", c.template, got, c.want)
+		}
+	}
+	if _, err := resolveTemplate("subject:{catgory}", record); err == nil {
+		t.Fatal("unknown field accepted")
+	}
+	if _, err := resolveTemplate("{opengraph}", record); err == nil {
+		t.Fatal("record field accepted")
+	}
+}
+
+// TestApplyPending ...
+func TestApplyPending(t *testing.T) {
+	client := storage.NewMemory("TestApplyPending", 0)
+	topic := TopicConfig{Topic: "roure.avro.comment", Partitions: 1, DeadLetter: "roure.avro.comment.dlq"}
+	conf := Config{
+		Kafka:   KafkaConfig{Backend: memkafka.BACKEND_MEMORY, Brokers: []Broker{{Addr: "TestApplyPending"}}, Topics: []TopicConfig{topic}},
+		Ledisdb: LedisdbConfig{Dialect: "ledis"},
+	}
+	registerTestGroup(t, CommandGroup{Name: "TEST_PENDING_FAIL", Froms: []string{FROM_VALUE}, Script: `return redis.call('NOSUCHCOMMAND', key)`})
+	pending := []pendingMessage{}
+	for i, id := range []string{"a", "b", "c"} {
+		cmds := []Command{{Group: "LISTS", Key: "comment:x", From: FROM_SELF}}
+		if id == "b" {
+			cmds = append(cmds, Command{Group: "TEST_PENDING_FAIL", Key: "comment:x", From: FROM_VALUE})
+		}
+		pending = append(pending, pendingMessage{msg: &kafka.Message{Topic: topic.Topic, Offset: int64(i), Value: []byte(id)}, cmds: cmds})
+	}
+	if err := applyPending(conf, client, nil, topic, pending); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := client.LRange("comment:x", 0, -1); len(items) != 2 || items[0] != "a" || items[1] != "c" {
+		t.Fatalf("list %v, want [a c]", items)
+	}
+	if offset, _ := Offset(client, topic.Topic, 0); offset != 3 {
+		t.Fatalf("offset %d, want 3", offset)
+	}
+	if last, _ := memoryBroker(conf).LastOffset(topic.DeadLetter, 0); last != 1 {
+		t.Fatalf("%d dead letters, want 1", last)
+	}
+}
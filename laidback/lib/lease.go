@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yasukun/roure/storage"
+)
+
+// LEASE_KEY_PREFIX prefixes the keys of partition leases and of their
+// fencing token counters.
+const LEASE_KEY_PREFIX = "lease:"
+
+// leaseScript acquires the lease of a partition for an owner, or renews it
+// when the owner still holds it with the given token. Every new lease takes
+// the next fencing token, so the writes of an instance that lost its lease
+// are told apart from those of the new holder. LedisDB knows no PX and
+// expires leases in whole seconds.
+//
+// KEYS[1] = lease key, KEYS[2] = token counter
+// ARGV[1] = owner, ARGV[2] = held token (0 to acquire), ARGV[3] = TTL in
+// milliseconds, ARGV[4] = dialect
+//
+// Returns the token of the lease, 0 when another owner holds it or the held
+// lease expired.
+const leaseScript = `
+local ttl = tonumber(ARGV[3])
+local current = redis.call('GET', KEYS[1])
+if ARGV[2] ~= '0' then
+	if current ~= ARGV[2] .. ':' .. ARGV[1] then
+		return 0
+	end
+	if ARGV[4] == 'redis' then
+		redis.call('PEXPIRE', KEYS[1], ttl)
+	else
+		redis.call('EXPIRE', KEYS[1], math.ceil(ttl / 1000))
+	end
+	return tonumber(ARGV[2])
+end
+if current then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+local value = token .. ':' .. ARGV[1]
+if ARGV[4] == 'redis' then
+	redis.call('SET', KEYS[1], value, 'NX', 'PX', ttl)
+else
+	redis.call('SETNX', KEYS[1], value)
+	redis.call('EXPIRE', KEYS[1], math.ceil(ttl / 1000))
+end
+return token
+`
+
+// releaseScript deletes the lease key if it still holds ARGV[1].
+const releaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// offsetScript sets a partition offset unless the lease key no longer holds
+// the lease of the caller, the same check the apply script makes.
+//
+// KEYS[1] = offset hash, KEYS[2] = lease key
+// ARGV[1] = offset field, ARGV[2] = offset, ARGV[3] = lease
+const offsetScript = `
+if redis.call('GET', KEYS[2]) ~= ARGV[3] then
+	return redis.error_reply('LEASE not held: ' .. KEYS[2])
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`
+
+var (
+	leaseScriptCmd   = storage.NewScript(leaseScript)
+	releaseScriptCmd = storage.NewScript(releaseScript)
+	offsetScriptCmd  = storage.NewScript(offsetScript)
+)
+
+// leaseKey ...
+func leaseKey(topic string, partition int) string {
+	return LEASE_KEY_PREFIX + offsetField(topic, partition)
+}
+
+// tokenKey ...
+func tokenKey(topic string, partition int) string {
+	return LEASE_KEY_PREFIX + "token:" + offsetField(topic, partition)
+}
+
+// isLeaseLost reports whether err is the apply script refusing the writes
+// of an instance that no longer holds the lease.
+func isLeaseLost(err error) bool {
+	if e, ok := err.(*applyError); ok {
+		err = e.Err
+	}
+	return err != nil && strings.HasPrefix(err.Error(), "LEASE")
+}
+
+// setLeasedOffset is SetOffset fenced by lease, which may be nil.
+func setLeasedOffset(client storage.Store, lease *Lease, topic string, partition int, offset int64) error {
+	if lease == nil {
+		return SetOffset(client, topic, partition, offset)
+	}
+	keys := []string{OFFSET_KEY, lease.key()}
+	_, err := client.Eval(offsetScriptCmd, keys, offsetField(topic, partition), offset, lease.value())
+	return err
+}
+
+// Lease is the ownership of one topic partition. The apply script checks
+// the lease key against Token and Owner before it writes anything.
+type Lease struct {
+	Topic     string
+	Partition int
+	Owner     string
+	Token     int64
+
+	mu   sync.Mutex
+	lost error
+}
+
+// key ...
+func (l *Lease) key() string {
+	return leaseKey(l.Topic, l.Partition)
+}
+
+// value is what the lease key holds while l is valid.
+func (l *Lease) value() string {
+	return fmt.Sprintf("%d:%s", l.Token, l.Owner)
+}
+
+// try acquires the lease, or renews it when l holds a token already.
+func (l *Lease) try(conf Config, client storage.Store) (bool, error) {
+	keys := []string{l.key(), tokenKey(l.Topic, l.Partition)}
+	token, err := storage.Int64(client.Eval(leaseScriptCmd, keys, l.Owner, l.Token, conf.Lease.TTL, conf.Ledisdb.Dialect))
+	if err != nil {
+		return false, err
+	}
+	if token == 0 {
+		return false, nil
+	}
+	if l.Token == 0 {
+		l.Token = token
+	}
+	return true, nil
+}
+
+// AcquireLease waits until conf.Lease.Owner holds the lease of the
+// partition or ctx is done. A lease that is not renewed is free again after
+// its TTL, which is how partitions of a crashed instance are taken over.
+func AcquireLease(ctx context.Context, conf Config, client storage.Store, topic string, partition int) (*Lease, error) {
+	l := &Lease{Topic: topic, Partition: partition, Owner: conf.Lease.Owner}
+	waiting := false
+	for {
+		ok, err := l.try(conf, client)
+		if err != nil {
+			return nil, fmt.Errorf("acquire lease error (%s): %v", l.key(), err)
+		}
+		if ok {
+			log.Printf("[lease] %s acquired (owner: %s, token: %d)\n", l.key(), l.Owner, l.Token)
+			partitionLeased.WithLabelValues(topic, strconv.Itoa(partition)).Set(1)
+			return l, nil
+		}
+		if !waiting {
+			log.Printf("[lease] %s held by another instance, standing by\n", l.key())
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(conf.Lease.Renew) * time.Millisecond):
+		}
+	}
+}
+
+// Keep renews l every renew interval until ctx is done. When the lease is
+// held by someone else, or cannot be renewed for its TTL, it calls lost and
+// the reader has to stop.
+func (l *Lease) Keep(ctx context.Context, conf Config, client storage.Store, lost func()) {
+	ticker := time.NewTicker(time.Duration(conf.Lease.Renew) * time.Millisecond)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ok, err := l.try(conf, client)
+		if err != nil && time.Since(renewed) < time.Duration(conf.Lease.TTL)*time.Millisecond {
+			log.Printf("[lease] %s renew error: %v\n", l.key(), err)
+			continue
+		}
+		if err == nil && !ok {
+			err = fmt.Errorf("lease %s lost (token: %d)", l.key(), l.Token)
+		}
+		if err == nil {
+			renewed = time.Now()
+		} else {
+			l.mu.Lock()
+			l.lost = err
+			l.mu.Unlock()
+			partitionLeased.WithLabelValues(l.Topic, strconv.Itoa(l.Partition)).Set(0)
+			lost()
+			return
+		}
+	}
+}
+
+// Err returns why the lease was lost, nil while it is held.
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Release gives the lease up so another instance can take the partition
+// over without waiting for the TTL.
+func (l *Lease) Release(client storage.Store) error {
+	partitionLeased.WithLabelValues(l.Topic, strconv.Itoa(l.Partition)).Set(0)
+	if _, err := client.Eval(releaseScriptCmd, []string{l.key()}, l.value()); err != nil {
+		return fmt.Errorf("release lease error (%s): %v", l.key(), err)
+	}
+	log.Printf("[lease] %s released (token: %d)\n", l.key(), l.Token)
+	return nil
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/memkafka"
+	"github.com/yasukun/roure/storage"
+)
+
+// TestLease ...
+func TestLease(t *testing.T) {
+	client := storage.NewMemory("TestLease", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "redis"}, Lease: LeaseConfig{TTL: 100, Renew: 20, Owner: "a"}}
+	ctx := context.Background()
+	a, err := AcquireLease(ctx, conf, client, "roure.avro.subject", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := conf
+	other.Lease.Owner = "b"
+	waiting, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireLease(waiting, other, client, "roure.avro.subject", 0); err != context.DeadlineExceeded {
+		t.Fatalf("b acquired a held lease: %v", err)
+	}
+
+	cmds := []Command{{Group: "SETS", Key: "subject:x", From: FROM_SELF}}
+	msg := kafka.Message{Topic: "roure.avro.subject", Value: []byte("a")}
+	if err := executeLeased(conf, client, a, []pendingMessage{{msg: &msg, cmds: cmds}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crashes: b takes over once the lease expired and fences a off
+	b, err := AcquireLease(ctx, other, client, "roure.avro.subject", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Token <= a.Token {
+		t.Fatalf("token %d after %d", b.Token, a.Token)
+	}
+	msg.Offset, msg.Value = 1, []byte("stale")
+	if err := executeLeased(conf, client, a, []pendingMessage{{msg: &msg, cmds: cmds}}); !isLeaseLost(err) {
+		t.Fatalf("stale lease error %v", err)
+	}
+	if v, _ := client.Eval(storage.NewScript(`return redis.call('GET', KEYS[1])`), []string{"subject:x"}); v != "a" {
+		t.Fatalf("value %v, want a", v)
+	}
+	if ok, _ := a.try(conf, client); ok {
+		t.Fatal("a renewed a lease it lost")
+	}
+
+	if err := a.Release(client); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.try(other, client); !ok {
+		t.Fatal("release of a stale lease removed the current one")
+	}
+}
+
+// TestDeadLetterLease ...
+func TestDeadLetterLease(t *testing.T) {
+	client := storage.NewMemory("TestDeadLetterLease", 0)
+	topic := TopicConfig{Topic: "roure.avro.comment", Partitions: 1, DeadLetter: "roure.avro.comment.dlq"}
+	conf := Config{
+		Kafka:   KafkaConfig{Backend: memkafka.BACKEND_MEMORY, Brokers: []Broker{{Addr: "TestDeadLetterLease"}}, Topics: []TopicConfig{topic}},
+		Ledisdb: LedisdbConfig{Dialect: "redis"},
+		Lease:   LeaseConfig{TTL: 50, Renew: 10, Owner: "a"},
+	}
+	ctx := context.Background()
+	a, err := AcquireLease(ctx, conf, client, topic.Topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := kafka.Message{Topic: topic.Topic, Offset: 4, Value: []byte("broken")}
+	if err := DeadLetter(conf, client, a, topic, &msg, errors.New("broken")); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := Offset(client, topic.Topic, 0); offset != 5 {
+		t.Fatalf("offset %d, want 5", offset)
+	}
+
+	// b takes the partition over while a still dead-letters a message
+	other := conf
+	other.Lease.Owner = "b"
+	if _, err := AcquireLease(ctx, other, client, topic.Topic, 0); err != nil {
+		t.Fatal(err)
+	}
+	msg.Offset = 9
+	if err := DeadLetter(conf, client, a, topic, &msg, errors.New("broken")); !isLeaseLost(err) {
+		t.Fatalf("stale lease error %v", err)
+	}
+	if offset, _ := Offset(client, topic.Topic, 0); offset != 5 {
+		t.Fatalf("offset %d, want 5", offset)
+	}
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yasukun/roure/storage"
+)
+
+const (
+	STAGE_DECODE      = "decode"
+	STAGE_EXECUTE     = "execute"
+	STAGE_OFFSET      = "offset"
+	STAGE_DEAD_LETTER = "dead_letter"
+	STAGE_ACL         = "acl"
+)
+
+var (
+	messagesConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laidback_messages_consumed_total",
+		Help: "Messages read from kafka.",
+	}, []string{"topic", "partition"})
+	commandsExecuted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laidback_commands_executed_total",
+		Help: "Commands applied to ledisdb per command group.",
+	}, []string{"group"})
+	stageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laidback_errors_total",
+		Help: "Errors per topic and stage (decode, execute, offset, dead_letter, acl).",
+	}, []string{"topic", "stage"})
+	applyLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "laidback_apply_duration_seconds",
+		Help:    "Time spent applying one message to ledisdb on its own.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"topic"})
+	applyBatchLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "laidback_apply_batch_duration_seconds",
+		Help:    "Time spent applying one batch of messages to ledisdb with one script call.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"topic"})
+	duplicatesSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laidback_duplicates_skipped_total",
+		Help: "Messages skipped because their event id was applied already.",
+	}, []string{"topic"})
+	partitionLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "laidback_partition_lag",
+		Help: "Broker high-water mark minus the offset stored in ledisdb.",
+	}, []string{"topic", "partition"})
+	partitionLeased = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "laidback_partition_leased",
+		Help: "1 while this instance holds the lease of the partition.",
+	}, []string{"topic", "partition"})
+)
+
+func init() {
+	prometheus.MustRegister(messagesConsumed, commandsExecuted, stageErrors, applyLatency, applyBatchLatency, duplicatesSkipped, partitionLag, partitionLeased)
+}
+
+// countError ...
+func countError(topic, stage string) {
+	stageErrors.WithLabelValues(topic, stage).Inc()
+}
+
+// ServeMetrics serves /metrics on addr.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// updateLag ...
+func updateLag(ctx context.Context, conf Config, client storage.Store) {
+	for _, topic := range conf.Kafka.Topics {
+		partitions, err := Partitions(conf, topic.Topic)
+		if err != nil {
+			log.Printf("[metrics] %v\n", err)
+			continue
+		}
+		for _, partition := range partitions {
+			last, err := LastOffset(ctx, conf, topic.Topic, partition)
+			if err != nil {
+				log.Printf("[metrics] %v\n", err)
+				continue
+			}
+			offset, err := Offset(client, topic.Topic, partition)
+			if err != nil {
+				offset = 0
+			}
+			partitionLag.WithLabelValues(topic.Topic, strconv.Itoa(partition)).Set(float64(last - offset))
+		}
+	}
+}
+
+// WatchLag refreshes the partition lag every interval until ctx is done.
+func WatchLag(ctx context.Context, conf Config, client storage.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		updateLag(ctx, conf, client)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
+)
+
+// swapScript swaps the rebuilt database in once its offsets for the given
+// fields equal the live ones. Offsets only found in the live database, such
+// as dead letter replay progress, are carried over. So are partition leases
+// and their fencing token counters, with the TTL they have left, so lease
+// holders keep writing and tokens keep growing. Needs SWAPDB, which LedisDB
+// lacks.
+//
+// KEYS[1] = offset hash, KEYS[2..] = lease keys and token counters
+// ARGV[1] = live db, ARGV[2] = rebuilt db, ARGV[3..] = offset fields
+const swapScript = `
+local live = redis.call('HGETALL', KEYS[1])
+local offsets = {}
+for i = 1, #live, 2 do
+	offsets[live[i]] = live[i + 1]
+end
+local leases = {}
+for i = 2, #KEYS do
+	local value = redis.call('GET', KEYS[i])
+	if value then
+		leases[KEYS[i]] = {value, redis.call('PTTL', KEYS[i])}
+	end
+end
+redis.call('SELECT', ARGV[2])
+for i = 3, #ARGV do
+	if redis.call('HGET', KEYS[1], ARGV[i]) ~= (offsets[ARGV[i]] or false) then
+		redis.call('SELECT', ARGV[1])
+		return 0
+	end
+end
+for i = 1, #live, 2 do
+	redis.call('HSETNX', KEYS[1], live[i], live[i + 1])
+end
+for k, lease in pairs(leases) do
+	if lease[2] > 0 then
+		redis.call('SET', k, lease[1], 'PX', lease[2])
+	elseif lease[2] == -1 then
+		redis.call('SET', k, lease[1])
+	end
+end
+redis.call('SELECT', ARGV[1])
+redis.call('SWAPDB', ARGV[1], ARGV[2])
+return 1
+`
+
+var swapCmd = storage.NewScript(swapScript)
+
+type rebuildProgress struct {
+	sync.Mutex
+	offsets map[string]int64
+	last    map[string]int64
+}
+
+// set ...
+func (p *rebuildProgress) set(field string, offset, last int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.offsets[field] = offset
+	if last >= 0 {
+		p.last[field] = last
+	}
+}
+
+// report ...
+func (p *rebuildProgress) report() {
+	p.Lock()
+	defer p.Unlock()
+	for field, offset := range p.offsets {
+		last := p.last[field]
+		pct := 100.0
+		if last > 0 {
+			pct = float64(offset) * 100 / float64(last)
+		}
+		log.Printf("[rebuild] %s %d/%d (%.1f%%)\n", field, offset, last, pct)
+	}
+}
+
+// rebuildPartition replays one partition from the beginning into target. It
+// never gets ahead of the live offset so the two can meet for the swap.
+func rebuildPartition(ctx context.Context, conf Config, live, target storage.Store, codec *avroreg.Codec, topic TopicConfig, partition int, progress *rebuildProgress) error {
+	field := offsetField(topic.Topic, partition)
+	// a partition without messages has to meet the live offset as well
+	if err := SetOffsetNX(target, topic.Topic, partition); err != nil {
+		return err
+	}
+	r := partitionReader(conf, topic, topic.Topic, partition)
+	defer r.Close()
+	r.SetOffset(kafka.FirstOffset)
+
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+		for {
+			liveOffset, err := Offset(live, topic.Topic, partition)
+			if err == nil && m.Offset < liveOffset {
+				progress.set(field, m.Offset, liveOffset)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		// event ids are kept so the swapped in db still skips duplicates
+		p, err := extractMessage(conf, topic, codec, &m)
+		if err == nil {
+			topic.authorize(&p)
+			err = executeBatch(conf, target, []pendingMessage{p})
+		}
+		if err != nil {
+			if isTransient(err) {
+				return err
+			}
+			// the live reader sent it to the dead letter topic already
+			log.Printf("[rebuild] skip %s offset %d: %v\n", field, m.Offset, err)
+			if err := SetOffset(target, topic.Topic, partition, m.Offset+1); err != nil {
+				return err
+			}
+		}
+		progress.set(field, m.Offset+1, -1)
+	}
+}
+
+// Rebuild replays every configured topic from the beginning into the
+// rebuild database and swaps it with the live one once it has caught up.
+func Rebuild(ctx context.Context, conf Config, live storage.Store, codecs map[string]*avroreg.Codec) error {
+	if conf.Rebuild.DB == conf.Ledisdb.DB {
+		return fmt.Errorf("rebuild db must differ from the live db (%d)", conf.Ledisdb.DB)
+	}
+	if conf.Rebuild.Swap && conf.Ledisdb.Dialect != "redis" {
+		return fmt.Errorf("rebuild swap needs SWAPDB, which the %s dialect lacks: set swap = false and point laidback at db %d once it caught up", conf.Ledisdb.Dialect, conf.Rebuild.DB)
+	}
+	target, err := OpenStore(conf, conf.Rebuild.DB)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	if err := target.FlushDB(); err != nil {
+		return fmt.Errorf("flush rebuild db error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	progress := &rebuildProgress{offsets: map[string]int64{}, last: map[string]int64{}}
+	fields := []interface{}{conf.Ledisdb.DB, conf.Rebuild.DB}
+	swapKeys := []string{OFFSET_KEY}
+	errs := make(chan error, 1)
+	wg := &sync.WaitGroup{}
+	for _, topic := range conf.Kafka.Topics {
+		partitions, err := Partitions(conf, topic.Topic)
+		if err != nil {
+			return err
+		}
+		if topic.DeadLetter != "" {
+			dlq, err := Partitions(conf, topic.DeadLetter)
+			if err != nil {
+				return err
+			}
+			for _, partition := range dlq {
+				swapKeys = append(swapKeys, leaseKey(topic.DeadLetter, partition), tokenKey(topic.DeadLetter, partition))
+			}
+		}
+		for _, partition := range partitions {
+			field := offsetField(topic.Topic, partition)
+			fields = append(fields, field)
+			swapKeys = append(swapKeys, leaseKey(topic.Topic, partition), tokenKey(topic.Topic, partition))
+			progress.set(field, 0, -1)
+			wg.Add(1)
+			go func(topic TopicConfig, partition int) {
+				defer wg.Done()
+				if err := rebuildPartition(ctx, conf, live, target, codecs[topic.Topic], topic, partition, progress); err != nil && ctx.Err() == nil {
+					select {
+					case errs <- fmt.Errorf("rebuild %s error: %v", offsetField(topic.Topic, partition), err):
+					default:
+					}
+				}
+			}(topic, partition)
+		}
+	}
+	// the readers only stop once ctx is cancelled
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	interval := time.Duration(conf.Rebuild.ProgressInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	report := time.NewTicker(interval)
+	defer report.Stop()
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case <-report.C:
+			progress.report()
+		case <-check.C:
+			if !conf.Rebuild.Swap {
+				if caughtUp(live, target, fields[2:]) {
+					progress.report()
+					log.Printf("[rebuild] caught up in db %d, swap disabled\n", conf.Rebuild.DB)
+					return nil
+				}
+				continue
+			}
+			swapped, err := storage.Int64(live.Eval(swapCmd, swapKeys, fields...))
+			if err != nil {
+				return fmt.Errorf("swap db error: %v", err)
+			}
+			if swapped == 1 {
+				progress.report()
+				log.Printf("[rebuild] swapped db %d with db %d\n", conf.Rebuild.DB, conf.Ledisdb.DB)
+				return nil
+			}
+		}
+	}
+}
+
+// caughtUp ...
+func caughtUp(live, target storage.Store, fields []interface{}) bool {
+	for _, f := range fields {
+		field := f.(string)
+		l, err := live.HGet(OFFSET_KEY, field)
+		if err != nil {
+			return false
+		}
+		t, err := target.HGet(OFFSET_KEY, field)
+		if err != nil || t != l {
+			return false
+		}
+	}
+	return true
+}
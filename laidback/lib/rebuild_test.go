@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/memkafka"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
+)
+
+// TestRebuildEmptyPartition ...
+func TestRebuildEmptyPartition(t *testing.T) {
+	topic := TopicConfig{Topic: "roure.avro.subject", Partitions: 2}
+	conf := Config{
+		Kafka:   KafkaConfig{Backend: memkafka.BACKEND_MEMORY, Brokers: []Broker{{Addr: "TestRebuildEmptyPartition"}}, Topics: []TopicConfig{topic}},
+		Ledisdb: LedisdbConfig{Backend: storage.BACKEND_MEMORY, Addr: "TestRebuildEmptyPartition", Dialect: "redis"},
+		Rebuild: RebuildConfig{DB: 1, Swap: true},
+	}
+	codec, err := avroreg.NewCodec(nil, `{"type": "record", "name": "subject", "fields": [{"name": "id", "type": "string"}]}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := codec.BinaryFromNative(nil, map[string]interface{}{"id": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one message lands in one partition, the other stays empty
+	broker := memoryBroker(conf)
+	if err := broker.WriteMessages(topic.Topic, kafka.Message{Key: []byte("x"), Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	live := storage.NewMemory("TestRebuildEmptyPartition", 0)
+	for _, partition := range []int{0, 1} {
+		last, err := broker.LastOffset(topic.Topic, partition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SetOffset(live, topic.Topic, partition, last); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Rebuild(ctx, conf, live, map[string]*avroreg.Codec{topic.Topic: codec}); err != nil {
+		t.Fatal(err)
+	}
+	for _, partition := range []int{0, 1} {
+		if _, err := Offset(live, topic.Topic, partition); err != nil {
+			t.Fatalf("partition %d: %v", partition, err)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yasukun/roure/storage"
+)
+
+const (
+	FROM_SELF           = "SELF"
+	FROM_PREVIOUS_VALUE = "PREVIOUS_VALUE"
+	FROM_VALUE          = "VALUE"
+	// FROM_RESULT takes the result an earlier command of the message named
+	// with As. Command.Value holds the name.
+	FROM_RESULT = "RESULT"
+)
+
+const (
+	TYPE_KV   = "kv"
+	TYPE_LIST = "list"
+	TYPE_HASH = "hash"
+	TYPE_ZSET = "zset"
+	TYPE_SET  = "set"
+)
+
+// CommandGroup describes how one Command.Group is executed. Script is the
+// body of a Lua function called as
+//
+//	function(key, field, value, raw, score, msg)
+//
+// where value is resolved from Command.From, raw is Command.Value and msg
+// holds the keys and raw values of all commands of the message, in order,
+// as msg.keys and msg.raws and the message itself as msg.value. Its
+// return value becomes the PREVIOUS_VALUE of the next command and, when
+// the command has As set, a result later commands can reference. Type is the
+// data type the group writes and selects the expire command for TTLs;
+// groups that only remove data leave it empty.
+//
+// Undo reverts the command when a later command of the message fails. It is
+// the body of a function called with the first five arguments of Script
+// followed by saved, what Save returned before Script ran, and result, what
+// Script returned. Messages with a command of a group without Undo are
+// reverted from copies of all their keys.
+type CommandGroup struct {
+	Name   string
+	Type   string
+	Froms  []string
+	Script string
+	Save   string
+	Undo   string
+}
+
+// accepts ...
+func (g CommandGroup) accepts(from string) bool {
+	for _, f := range g.Froms {
+		if f == from {
+			return true
+		}
+	}
+	return false
+}
+
+// GROUP_SCRIPT runs the registered script Command.Field names.
+const GROUP_SCRIPT = "SCRIPT"
+
+var registry = struct {
+	sync.RWMutex
+	groups  map[string]CommandGroup
+	scripts map[string]string
+	apply   *storage.Script
+}{groups: map[string]CommandGroup{}, scripts: map[string]string{}}
+
+// RegisterGroup adds a command group. Registering a name twice is an error.
+func RegisterGroup(group CommandGroup) error {
+	if group.Name == "" || group.Script == "" {
+		return errors.New("command group needs a name and a script")
+	}
+	if len(group.Froms) == 0 {
+		return fmt.Errorf("command group %s accepts no from", group.Name)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.groups[group.Name]; ok {
+		return fmt.Errorf("command group %s already registered", group.Name)
+	}
+	registry.groups[group.Name] = group
+	registry.apply = storage.NewScript(buildApplyScript(registry.groups, registry.scripts))
+	return nil
+}
+
+// unregisterGroup removes a command group again, for tests that register
+// their own.
+func unregisterGroup(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.groups, name)
+	registry.apply = storage.NewScript(buildApplyScript(registry.groups, registry.scripts))
+}
+
+// RegisterScript adds a named script for the SCRIPT group. Registering a
+// name again is only allowed with the same source.
+func RegisterScript(name, src string) error {
+	if name == "" || src == "" {
+		return errors.New("script needs a name and a source")
+	}
+	if err := storage.Compile(src); err != nil {
+		return fmt.Errorf("script %s: %v", name, err)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if old, ok := registry.scripts[name]; ok {
+		if old == src {
+			return nil
+		}
+		return fmt.Errorf("script %s already registered", name)
+	}
+	registry.scripts[name] = src
+	registry.apply = storage.NewScript(buildApplyScript(registry.groups, registry.scripts))
+	return nil
+}
+
+// unregisterScript removes a named script again, for tests that register
+// their own.
+func unregisterScript(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.scripts, name)
+	registry.apply = storage.NewScript(buildApplyScript(registry.groups, registry.scripts))
+}
+
+// RegisterScripts registers the scripts of conf.
+func RegisterScripts(conf Config) error {
+	for _, script := range conf.Scripts {
+		if err := RegisterScript(script.Name, script.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadScripts loads the apply script with the registered groups and scripts
+// into client with SCRIPT LOAD; batches then run it with EVALSHA. Named
+// scripts are inlined into it rather than loaded and run on their own:
+// their writes then commit with the offset of the message or not at all,
+// and a script cannot EVALSHA another. RegisterScript already compiled
+// each, so a broken one is reported by name.
+func LoadScripts(client storage.Store) error {
+	if err := client.Load(applyScriptCmd()); err != nil {
+		return fmt.Errorf("load apply script error: %v", err)
+	}
+	return nil
+}
+
+// lookupScript ...
+func lookupScript(name string) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	_, ok := registry.scripts[name]
+	return ok
+}
+
+// LookupGroup ...
+func LookupGroup(name string) (CommandGroup, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	group, ok := registry.groups[name]
+	return group, ok
+}
+
+// Groups ...
+func Groups() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := []string{}
+	for name := range registry.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateCommand checks that cmd names a registered group and a from the
+// group accepts. Groups without a type, such as SCRIPT, have no expire
+// command and take no TTL.
+func ValidateCommand(cmd *Command) error {
+	group, ok := LookupGroup(cmd.Group)
+	if !ok {
+		return fmt.Errorf("unknown command group: %s", cmd.Group)
+	}
+	if !group.accepts(cmd.From) {
+		return fmt.Errorf("command group %s does not accept from %s", cmd.Group, cmd.From)
+	}
+	if cmd.TTL > 0 && group.Type == "" {
+		return fmt.Errorf("command group %s takes no ttl", cmd.Group)
+	}
+	if cmd.Group == GROUP_SCRIPT && !lookupScript(cmd.Field) {
+		return fmt.Errorf("unknown script: %s", cmd.Field)
+	}
+	return nil
+}
+
+// ValidateRefs checks that every RESULT command of a message references a
+// result named by an earlier command.
+func ValidateRefs(cmds []Command) error {
+	named := map[string]bool{}
+	for i, cmd := range cmds {
+		if cmd.From == FROM_RESULT && !named[cmd.Value] {
+			return fmt.Errorf("command %d references unknown result %q", i+1, cmd.Value)
+		}
+		if cmd.As != "" {
+			named[cmd.As] = true
+		}
+	}
+	return nil
+}
+
+// expireCommand returns the command that sets a TTL on keys of the given
+// type. LedisDB keeps a separate keyspace per type and expires each with
+// its own command.
+func expireCommand(conf Config, typ string) string {
+	if typ == "" {
+		return ""
+	}
+	if conf.Ledisdb.Dialect == "redis" {
+		return "EXPIRE"
+	}
+	switch typ {
+	case TYPE_LIST:
+		return "LEXPIRE"
+	case TYPE_HASH:
+		return "HEXPIRE"
+	case TYPE_ZSET:
+		return "ZEXPIRE"
+	case TYPE_SET:
+		return "SEXPIRE"
+	}
+	return "EXPIRE"
+}
+
+// commandTTL returns the TTL of cmd in seconds, falling back to the
+// default of the longest matching key prefix. Groups without a type have
+// no expire command and get none.
+func commandTTL(conf Config, cmd *Command) int64 {
+	if group, ok := LookupGroup(cmd.Group); ok && group.Type == "" {
+		return 0
+	}
+	if cmd.TTL > 0 {
+		return cmd.TTL
+	}
+	var ttl int64
+	matched := -1
+	for _, t := range conf.TTLs {
+		if strings.HasPrefix(cmd.Key, t.Prefix) && len(t.Prefix) > matched {
+			ttl = t.TTL
+			matched = len(t.Prefix)
+		}
+	}
+	return ttl
+}
+
+// applyScriptCmd ...
+func applyScriptCmd() *storage.Script {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.apply
+}
+
+// buildApplyScript ...
+func buildApplyScript(groups map[string]CommandGroup, scripts map[string]string) string {
+	var buf bytes.Buffer
+	names := []string{}
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf.WriteString(applyPrelude)
+	buf.WriteString("local scripts = {}\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "scripts[%q] = function(KEYS, ARGV)\n%s\nend\n", name, scripts[name])
+	}
+	names = []string{}
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf.WriteString("local groups, saves, undos = {}, {}, {}\n")
+	for _, name := range names {
+		group := groups[name]
+		fmt.Fprintf(&buf, "groups[%q] = function(key, field, value, raw, score, msg)\n%s\nend\n", name, group.Script)
+		if group.Save != "" {
+			fmt.Fprintf(&buf, "saves[%q] = function(key, field, value, raw, score)\n%s\nend\n", name, group.Save)
+		}
+		if group.Undo != "" {
+			fmt.Fprintf(&buf, "undos[%q] = function(key, field, value, raw, score, saved, result)\n%s\nend\n", name, group.Undo)
+		}
+	}
+	buf.WriteString(applyScript)
+	return buf.String()
+}
+
+// zsetUndo puts back the score a sorted set member had before the command.
+const zsetUndo = `if saved then
+	redis.call('ZADD', key, saved, value)
+else
+	redis.call('ZREM', key, value)
+end`
+
+var builtinGroups = []CommandGroup{
+	{
+		Name:   "LISTS",
+		Type:   TYPE_LIST,
+		Froms:  []string{FROM_SELF, FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `return redis.call('RPUSH', key, value)`,
+		Undo:   `redis.call('RPOP', key)`,
+	},
+	{
+		Name:   "HASHES",
+		Type:   TYPE_HASH,
+		Froms:  []string{FROM_SELF, FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `return redis.call('HSET', key, field, value)`,
+		Save:   `return redis.call('HGET', key, field)`,
+		Undo: `if saved then
+	redis.call('HSET', key, field, saved)
+else
+	redis.call('HDEL', key, field)
+end`,
+	},
+	{
+		Name:   "SETS",
+		Type:   TYPE_KV,
+		Froms:  []string{FROM_SELF, FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `return redis.call('SET', key, value)`,
+		Save:   `return redis.call('GET', key)`,
+		Undo: `if saved then
+	redis.call('SET', key, saved)
+else
+	redis.call('DEL', key)
+end`,
+	},
+	{
+		Name:   "ZINCRBY",
+		Type:   TYPE_ZSET,
+		Froms:  []string{FROM_VALUE},
+		Script: `return redis.call('ZINCRBY', key, score, value)`,
+		Save:   `return redis.call('ZSCORE', key, value)`,
+		Undo:   zsetUndo,
+	},
+	{
+		Name:   "ZADD",
+		Type:   TYPE_ZSET,
+		Froms:  []string{FROM_VALUE},
+		Script: `return redis.call('ZADD', key, score, value)`,
+		Save:   `return redis.call('ZSCORE', key, value)`,
+		Undo:   zsetUndo,
+	},
+	{
+		Name:   "DEL",
+		Froms:  []string{FROM_VALUE},
+		Script: `return clear(key)`,
+		Save:   `return snapshot(key)`,
+		Undo:   `restore(key, saved)`,
+	},
+	{
+		Name:   "HDEL",
+		Froms:  []string{FROM_VALUE},
+		Script: `return redis.call('HDEL', key, field)`,
+		Save:   `return redis.call('HGET', key, field)`,
+		Undo: `if saved then
+	redis.call('HSET', key, field, saved)
+end`,
+	},
+	{
+		Name:   "LREM",
+		Froms:  []string{FROM_SELF, FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `return redis.call('LREM', key, 0, value)`,
+		Save:   `return snapshot(key)`,
+		Undo:   `restore(key, saved)`,
+	},
+	{
+		Name:   "SREM",
+		Froms:  []string{FROM_SELF, FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `return redis.call('SREM', key, value)`,
+		Save:   `return redis.call('SISMEMBER', key, value)`,
+		Undo: `if saved == 1 then
+	redis.call('SADD', key, value)
+end`,
+	},
+	{
+		Name:   "ZREM",
+		Froms:  []string{FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `return redis.call('ZREM', key, value)`,
+		Save:   `return redis.call('ZSCORE', key, value)`,
+		Undo:   zsetUndo,
+	},
+	{
+		// errors returned by the script fail the command like raised ones
+		Name:  GROUP_SCRIPT,
+		Froms: []string{FROM_SELF, FROM_PREVIOUS_VALUE, FROM_VALUE, FROM_RESULT},
+		Script: `local script = scripts[field]
+if not script then
+	error('unknown script: ' .. field)
+end
+local keys, argv = {key}, {value, score, msg.value}
+for i, k in ipairs(msg.keys) do
+	keys[i + 1] = k
+	argv[i + 3] = msg.raws[i]
+end
+local result = script(keys, argv)
+if type(result) == 'table' and result.err then
+	error(result)
+end
+return result`,
+	},
+}
+
+func init() {
+	for _, group := range builtinGroups {
+		if err := RegisterGroup(group); err != nil {
+			panic(err)
+		}
+	}
+}
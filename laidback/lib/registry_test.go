@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestValidateCommand ...
+func TestValidateCommand(t *testing.T) {
+	if err := ValidateCommand(&Command{Group: "LISTS", From: FROM_SELF}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateCommand(&Command{Group: "ZADD", From: FROM_SELF}); err == nil {
+		t.Fatal("ZADD accepted from SELF")
+	}
+	if err := ValidateCommand(&Command{Group: "NOPE", From: FROM_VALUE}); err == nil {
+		t.Fatal("unknown group accepted")
+	}
+	if err := ValidateCommand(&Command{Group: "DEL", From: FROM_VALUE, TTL: 60}); err == nil {
+		t.Fatal("ttl accepted on a group without a type")
+	}
+}
+
+// registerTestGroup registers group for the rest of the test.
+func registerTestGroup(t *testing.T, group CommandGroup) {
+	t.Helper()
+	if err := RegisterGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterGroup(group.Name) })
+}
+
+// registerTestScript registers a named script for the duration of t.
+func registerTestScript(t *testing.T, name, src string) {
+	t.Helper()
+	if err := RegisterScript(name, src); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterScript(name) })
+}
+
+// TestRegisterGroup ...
+func TestRegisterGroup(t *testing.T) {
+	if err := RegisterGroup(CommandGroup{Name: "LISTS", Froms: []string{FROM_VALUE}, Script: "return 0"}); err == nil {
+		t.Fatal("duplicate group registered")
+	}
+	group := CommandGroup{Name: "TEST_APPEND", Froms: []string{FROM_VALUE}, Script: `return redis.call('APPEND', key, value)`}
+	registerTestGroup(t, group)
+	if err := ValidateCommand(&Command{Group: "TEST_APPEND", From: FROM_VALUE}); err != nil {
+		t.Fatal(err)
+	}
+	script := buildApplyScript(map[string]CommandGroup{group.Name: group}, map[string]string{})
+	if !strings.Contains(script, `groups["TEST_APPEND"] = function(key, field, value, raw, score, msg)`) {
+		t.Fatal(script)
+	}
+	unregisterGroup(group.Name)
+	if _, ok := LookupGroup(group.Name); ok || strings.Contains(applyScriptCmd().Src, "TEST_APPEND") {
+		t.Fatal("unregistered group still in the apply script")
+	}
+	if err := RegisterScript("test_broken", "return ("); err == nil || !strings.Contains(err.Error(), "test_broken") {
+		t.Fatalf("broken script registered: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package lib
+
+import "fmt"
+
+// RuleConfig is a projection rule of a topic. Messages that carry no
+// commands are projected with the rules of their topic instead. Key, Field
+// and Value are templates resolved from the message, like embedded
+// commands.
+type RuleConfig struct {
+	// Event limits the rule to messages whose event field has this value.
+	Event     string   `toml:"event"`
+	Group     string   `toml:"group"`
+	Key       string   `toml:"key"`
+	Field     string   `toml:"field"`
+	From      string   `toml:"from"`
+	Value     string   `toml:"value"`
+	TTL       int64    `toml:"ttl"`
+	Score     *float64 `toml:"score"`
+	ScoreFrom string   `toml:"score_from"`
+	As        string   `toml:"as"`
+}
+
+// score ...
+func (r RuleConfig) score(record map[string]interface{}) (float64, error) {
+	if r.ScoreFrom != "" {
+		v, _ := recordField(record, r.ScoreFrom)
+		score, ok := numeric(v)
+		if !ok {
+			return 0, fmt.Errorf("score field %s is not numeric", r.ScoreFrom)
+		}
+		return score, nil
+	}
+	if r.Score != nil {
+		return *r.Score, nil
+	}
+	return 1, nil
+}
+
+// event returns the event type of record, empty without an event field.
+func (t TopicConfig) event(record map[string]interface{}) string {
+	if t.EventField == "" {
+		return ""
+	}
+	v, _ := recordField(record, t.EventField)
+	event, _ := templateValue(v)
+	return event
+}
+
+// ruleCmds builds the commands the rules of t give for record.
+func (t TopicConfig) ruleCmds(record map[string]interface{}) ([]Command, error) {
+	cmds := []Command{}
+	event := t.event(record)
+	for _, rule := range t.Rules {
+		if rule.Event != "" && rule.Event != event {
+			continue
+		}
+		score, err := rule.score(record)
+		if err != nil {
+			return cmds, err
+		}
+		cmd := Command{
+			Group: rule.Group,
+			Key:   rule.Key,
+			Field: rule.Field,
+			From:  rule.From,
+			Value: rule.Value,
+			TTL:   rule.TTL,
+			Score: score,
+			As:    rule.As,
+		}
+		for _, s := range []*string{&cmd.Key, &cmd.Field, &cmd.Value} {
+			if *s, err = resolveTemplate(*s, record); err != nil {
+				return cmds, err
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
@@ -0,0 +1,42 @@
+package lib
+
+import "testing"
+
+// TestRuleCmds ...
+func TestRuleCmds(t *testing.T) {
+	conf, err := DecodeConfigToml("../laidback.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := topicConfig(conf, "roure.avro.subject")
+	record := map[string]interface{}{"id": "x1", "category": "news", "uts": int64(1527209139), "redis": []interface{}{}}
+	cmds, err := topic.ruleCmds(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Command{
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF, Score: 1},
+		{Group: "HASHES", Key: "subject:news", Field: "Inverted:x1", From: FROM_PREVIOUS_VALUE, Score: 1},
+		{Group: "ZADD", Key: "subject:news", From: FROM_VALUE, Value: "x1", Score: 1527209139},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("got %v, want %v", cmds, want)
+	}
+	for i := range want {
+		if cmds[i] != want[i] {
+			t.Fatalf("command %d: got %+v, want %+v", i, cmds[i], want[i])
+		}
+	}
+
+	topic = TopicConfig{EventField: "name", Rules: []RuleConfig{
+		{Event: "fav", Group: "ZINCRBY", Key: "fav:{id}", From: FROM_VALUE, Value: "{id}"},
+		{Event: "view", Group: "ZINCRBY", Key: "view:{id}", From: FROM_VALUE, Value: "{id}"},
+	}}
+	cmds, err = topic.ruleCmds(map[string]interface{}{"id": "x1", "name": "view"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 1 || cmds[0].Key != "view:x1" {
+		t.Fatalf("event rules: got %v", cmds)
+	}
+}
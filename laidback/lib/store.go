@@ -3,19 +3,70 @@ package lib
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/go-redis/redis"
 	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/storage"
 )
 
 const OFFSET_KEY = "offset"
 
+// APPLIED_KEY_PREFIX prefixes the keys remembering applied event ids.
+const APPLIED_KEY_PREFIX = "applied:"
+
+type applyError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *applyError) Error() string {
+	return fmt.Sprintf("apply message error (offset=%d): %v", e.Offset, e.Err)
+}
+
+// isTransient reports whether err is a ledisdb error worth retrying, such as
+// a dropped connection or a server that is still loading.
+func isTransient(err error) bool {
+	if e, ok := err.(*applyError); ok {
+		err = e.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	for _, prefix := range []string{"LOADING", "READONLY", "TRYAGAIN", "BUSY", "redis: connection pool timeout"} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// offsetField ...
+func offsetField(topic string, partition int) string {
+	return fmt.Sprintf("%s:%d", topic, partition)
+}
+
+// OpenStore opens database db with the configured storage backend.
+func OpenStore(conf Config, db int) (storage.Store, error) {
+	return storage.Open(storage.Options{
+		Backend:  conf.Ledisdb.Backend,
+		Addr:     conf.Ledisdb.Addr,
+		Password: conf.Ledisdb.Password,
+		DB:       db,
+	})
+}
+
 // Offset ...
-func Offset(client *redis.Client, topic string, partition int) (int64, error) {
-	field := fmt.Sprintf("%s:%d", topic, partition)
-	result, err := client.HGet(OFFSET_KEY, field).Result()
+func Offset(client storage.Store, topic string, partition int) (int64, error) {
+	field := offsetField(topic, partition)
+	result, err := client.HGet(OFFSET_KEY, field)
 	if err != nil {
 		return -1, errors.New(fmt.Sprintf("read offset error: %v", err))
 	}
@@ -27,9 +78,9 @@ func Offset(client *redis.Client, topic string, partition int) (int64, error) {
 }
 
 // SetOffsetNX ...
-func SetOffsetNX(client *redis.Client, topic string, partition int) error {
-	field := fmt.Sprintf("%s:%d", topic, partition)
-	if exists := client.HExists(OFFSET_KEY, field).Val(); !exists {
+func SetOffsetNX(client storage.Store, topic string, partition int) error {
+	field := offsetField(topic, partition)
+	if exists, _ := client.HExists(OFFSET_KEY, field); !exists {
 		if err := SetOffset(client, topic, partition, 0); err != nil {
 			return err
 		}
@@ -38,188 +89,385 @@ func SetOffsetNX(client *redis.Client, topic string, partition int) error {
 }
 
 // SetOffset ...
-func SetOffset(client *redis.Client, topic string, partition int, offset int64) error {
+func SetOffset(client storage.Store, topic string, partition int, offset int64) error {
 	value := strconv.FormatInt(offset, 10)
-	field := fmt.Sprintf("%s:%d", topic, partition)
-	if err := client.HSet(OFFSET_KEY, field, value).Err(); err != nil {
+	field := offsetField(topic, partition)
+	if err := client.HSet(OFFSET_KEY, field, value); err != nil {
 		return err
 	}
 	return nil
 }
 
-// ExecList ...
-func ExecList(conf Config, client *redis.Client, cmd *Command, msg *kafka.Message, previousValue interface{}) (interface{}, error) {
-	var result interface{}
-	var err error
-	if conf.Main.Debug {
-		log.Printf("[RPush] key: %s\n", cmd.Key)
-	}
-	switch (*cmd).From {
-	case "SELF":
-		if conf.Main.Debug {
-			log.Printf("[RPush] value(self): %s\n", msg.Value)
-		}
-		result, err = client.RPush(cmd.Key, msg.Value).Result()
-		if err != nil {
-			return result, err
-		}
-	case "PREVIOUS_VALUE":
-		if conf.Main.Debug {
-			log.Printf("[RPush] value(previous value): %s\n", previousValue)
-		}
-		result, err = client.RPush(cmd.Key, previousValue).Result()
-		if err != nil {
-			return result, err
-		}
-	case "VALUE":
-		if conf.Main.Debug {
-			log.Printf("[RPush] value(value): %s\n", cmd.Value)
-		}
-		result, err = client.RPush(cmd.Key, cmd.Value).Result()
-		if err != nil {
-			return result, err
+// applyPrelude comes before the command groups, which may use its helpers.
+// read returns nil where a command fails, clear deletes key whatever type
+// it holds: LedisDB keeps one keyspace per type and its DEL only removes
+// strings. snapshot copies key with its TTLs for restore, unless it holds
+// more than the snapshot limit of elements; restore then fails rather than
+// put back part of it.
+const applyPrelude = `
+local dialect, snapshotLimit = ARGV[5], tonumber(ARGV[6])
+
+local function read(...)
+	local r = redis.pcall(...)
+	if type(r) == 'table' and r.err then
+		return nil
+	end
+	return r
+end
+
+local function clear(k)
+	local n = redis.call('DEL', k)
+	if dialect ~= 'redis' then
+		for _, c in ipairs({'LCLEAR', 'HCLEAR', 'ZCLEAR', 'SCLEAR'}) do
+			n = n + redis.call(c, k)
+		end
+	end
+	return n
+end
+
+local ttls = {TTL = 'EXPIRE', LTTL = 'LEXPIRE', HTTL = 'HEXPIRE', ZTTL = 'ZEXPIRE', STTL = 'SEXPIRE'}
+if dialect == 'redis' then
+	ttls = {PTTL = 'PEXPIRE'}
+end
+
+local function snapshot(k)
+	local size = 0
+	for _, c in ipairs({'LLEN', 'HLEN', 'ZCARD', 'SCARD'}) do
+		size = size + (read(c, k) or 0)
+	end
+	if size > snapshotLimit then
+		return false
+	end
+	local s = {kv = read('GET', k), list = read('LRANGE', k, 0, -1), hash = read('HGETALL', k), zset = read('ZRANGE', k, 0, -1, 'WITHSCORES'), set = read('SMEMBERS', k), ttls = {}}
+	for get, set in pairs(ttls) do
+		local ttl = read(get, k)
+		if ttl and ttl > 0 then
+			s.ttls[set] = ttl
+		end
+	end
+	return s
+end
+
+local function restore(k, s)
+	if not s then
+		error('no copy of ' .. k .. ', it held more than ' .. snapshotLimit .. ' elements')
+	end
+	clear(k)
+	if s.kv then
+		redis.call('SET', k, s.kv)
+	end
+	for _, v in ipairs(s.list or {}) do
+		redis.call('RPUSH', k, v)
+	end
+	local hash, zset = s.hash or {}, s.zset or {}
+	for i = 1, #hash, 2 do
+		redis.call('HSET', k, hash[i], hash[i + 1])
+	end
+	for i = 1, #zset, 2 do
+		redis.call('ZADD', k, zset[i + 1], zset[i])
+	end
+	for _, v in ipairs(s.set or {}) do
+		redis.call('SADD', k, v)
+	end
+	for set, ttl in pairs(s.ttls) do
+		redis.call(set, k, ttl)
+	end
+end
+`
+
+// applyScript applies a batch of messages of one partition in order and
+// writes the partition offset once at the end. Messages whose offset is
+// already behind the stored one are skipped, which keeps retries safe.
+// Messages whose applied key exists were applied before under another
+// offset, e.g. after an offset rollback, and only move the offset.
+// PREVIOUS_VALUE refers to the previous command of the same message, RESULT
+// to the result an earlier command of the message named with as. A message
+// is applied whole or not at all: TTLs are set once all its commands ran,
+// and when a command fails the commands before it are reverted with the
+// Undo of their group. A command whose group has no Undo, such as SCRIPT,
+// may write any key of the message and is reverted from copies of all of
+// them, taken just before it ran. Keys holding more than ARGV[6] elements
+// are not copied, and a failure after a command that needed such a copy is
+// reported as an undo failure. The offset is then moved past the messages
+// handled before the failed one.
+// When the partition is leased nothing is written unless the lease key
+// still holds the lease of the caller. The registered command groups are
+// prepended as the groups, saves and undos tables, after applyPrelude;
+// group functions get the keys, raw values and value of the whole message
+// as a sixth argument.
+//
+// KEYS[1] = offset hash, KEYS[2] = lease key, KEYS[3..] = command keys
+// ARGV[1] = offset field, ARGV[2] = applied key TTL, ARGV[3] = number of
+// messages, ARGV[4] = lease (empty for none), ARGV[5] = dialect, ARGV[6] =
+// snapshot limit, followed by offset, value, applied key (empty for none)
+// and number of commands for each message, each followed by group, field,
+// from, value, ttl, expire command, score and as for each of its commands.
+//
+// Returns the status of every message, 0 = behind the offset, 1 = applied,
+// 2 = duplicate. A failure is returned as an error starting with
+// "apply error (offset=N)", N being the offset of the failed message.
+const applyScript = `
+local function revert(entry)
+	if entry.snapshots then
+		for k, s in pairs(entry.snapshots) do
+			restore(k, s)
+		end
+		return
+	end
+	local a = entry.args
+	undos[entry.group](a[1], a[2], a[3], a[4], a[5], entry.saved, entry.result)
+end
+
+local messages = {}
+local pos, key = 7, 3
+for m = 1, tonumber(ARGV[3]) do
+	local msg = {offset = tonumber(ARGV[pos]), value = ARGV[pos + 1], applied = ARGV[pos + 2], count = tonumber(ARGV[pos + 3]), key = key, base = pos + 4}
+	for c = 0, msg.count - 1 do
+		local name = ARGV[msg.base + c * 8]
+		if not groups[name] then
+			return redis.error_reply('unknown command group: ' .. name)
+		end
+	end
+	messages[m] = msg
+	pos = msg.base + msg.count * 8
+	key = key + msg.count
+end
+if ARGV[4] ~= '' and redis.call('GET', KEYS[2]) ~= ARGV[4] then
+	return redis.error_reply('LEASE not held: ' .. KEYS[2])
+end
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+current = current and tonumber(current) or -1
+local advanced = false
+local statuses = {}
+for i, msg in ipairs(messages) do
+	statuses[i] = 0
+	if msg.offset >= current and msg.applied ~= '' and redis.call('GET', msg.applied) then
+		statuses[i] = 2
+	elseif msg.offset >= current then
+		local previous = ''
+		local results = {}
+		local done = {}
+		local expires = {}
+		local info = {keys = {}, raws = {}, value = msg.value}
+		for c = 0, msg.count - 1 do
+			info.keys[c + 1] = KEYS[msg.key + c]
+			info.raws[c + 1] = ARGV[msg.base + c * 8 + 3]
+		end
+		local function fail(err)
+			local undone, undoErr = pcall(function()
+				for j = #done, 1, -1 do
+					revert(done[j])
+				end
+			end)
+			if advanced then
+				redis.call('HSET', KEYS[1], ARGV[1], current)
+			end
+			if type(err) == 'table' and err.err then
+				err = err.err
+			end
+			local reply = 'apply error (offset=' .. msg.offset .. '): ' .. tostring(err)
+			if not undone then
+				reply = reply .. ' (undo failed: ' .. tostring(undoErr) .. ')'
+			end
+			return redis.error_reply(reply)
+		end
+		for c = 0, msg.count - 1 do
+			local base = msg.base + c * 8
+			local group, field, from, value = ARGV[base], ARGV[base + 1], ARGV[base + 2], ARGV[base + 3]
+			local ttl, expire, score, as = tonumber(ARGV[base + 4]), ARGV[base + 5], ARGV[base + 6], ARGV[base + 7]
+			local k = KEYS[msg.key + c]
+			local arg = value
+			if from == 'SELF' then
+				arg = msg.value
+			elseif from == 'PREVIOUS_VALUE' then
+				arg = previous
+			elseif from == 'RESULT' then
+				arg = results[value] or ''
+			end
+			local entry = {group = group, args = {k, field, arg, value, score}}
+			if not undos[group] then
+				entry.snapshots = {}
+				done[#done + 1] = entry
+			end
+			local ok, result = pcall(function()
+				if entry.snapshots then
+					for _, mk in ipairs(info.keys) do
+						if entry.snapshots[mk] == nil then
+							entry.snapshots[mk] = snapshot(mk)
+						end
+					end
+				elseif saves[group] then
+					entry.saved = saves[group](k, field, arg, value, score)
+				end
+				return groups[group](k, field, arg, value, score, info)
+			end)
+			if not ok then
+				return fail(result)
+			end
+			if type(result) == 'table' and result.ok then
+				result = result.ok
+			end
+			entry.result = result
+			if not entry.snapshots then
+				done[#done + 1] = entry
+			end
+			if ttl > 0 and expire ~= '' then
+				expires[#expires + 1] = {expire, k, ttl}
+			end
+			previous = result
+			if as ~= '' then
+				results[as] = result
+			end
+		end
+		local ok, err = pcall(function()
+			for _, e in ipairs(expires) do
+				redis.call(e[1], e[2], e[3])
+			end
+		end)
+		if not ok then
+			return fail(err)
+		end
+		if msg.applied ~= '' then
+			redis.call('SET', msg.applied, msg.offset)
+			redis.call('EXPIRE', msg.applied, ARGV[2])
+		end
+		statuses[i] = 1
+	end
+	if statuses[i] > 0 then
+		current = msg.offset + 1
+		advanced = true
+	end
+end
+if advanced then
+	redis.call('HSET', KEYS[1], ARGV[1], current)
+end
+return statuses
+`
+
+const (
+	MESSAGE_BEHIND    = 0
+	MESSAGE_APPLIED   = 1
+	MESSAGE_DUPLICATE = 2
+)
+
+// pendingMessage is a decoded message waiting to be applied. Messages with
+// an id are applied once per dedup window.
+type pendingMessage struct {
+	msg  *kafka.Message
+	cmds []Command
+	id   string
+}
+
+// appliedKey ...
+func appliedKey(topic, id string) string {
+	return APPLIED_KEY_PREFIX + topic + ":" + id
+}
+
+// ExecuteLedisCmds ...
+func ExecuteLedisCmds(conf Config, client storage.Store, cmds *[]Command, msg *kafka.Message) error {
+	return executeBatch(conf, client, []pendingMessage{{msg: msg, cmds: *cmds}})
+}
+
+// executeBatch applies messages of one partition, oldest first, with a
+// single script call.
+func executeBatch(conf Config, client storage.Store, batch []pendingMessage) error {
+	return executeLeased(conf, client, nil, batch)
+}
+
+// rejectMessage applies the messages before batch[i], which failed
+// validation, and returns its error.
+func rejectMessage(conf Config, client storage.Store, lease *Lease, batch []pendingMessage, i int, err error) error {
+	if i > 0 {
+		if err := executeLeased(conf, client, lease, batch[:i]); err != nil {
+			return err
 		}
-	default:
-		log.Printf("[RPush] command no match: %s\n", cmd.From)
-	}
-	if conf.Main.Debug {
-		log.Printf("[RPush] result: %v\n", result)
 	}
-	return result, nil
+	return &applyError{Offset: batch[i].msg.Offset, Err: err}
 }
 
-// ExecHash ...
-func ExecHash(conf Config, client *redis.Client, cmd *Command, msg *kafka.Message, previousValue interface{}) (interface{}, error) {
-	var result interface{}
-	var err error
-	if conf.Main.Debug {
-		log.Printf("[HSet] key: %s, field: %s\n", cmd.Key, cmd.Field)
+// failedOffset reads the offset of the failed message from an apply script
+// error, or returns fallback for errors raised before any message.
+func failedOffset(err error, fallback int64) int64 {
+	const marker = "apply error (offset="
+	msg := err.Error()
+	i := strings.Index(msg, marker)
+	if i < 0 {
+		return fallback
 	}
-	switch (*cmd).From {
-	case "SELF":
-		if conf.Main.Debug {
-			log.Printf("[Hset] value(self): %s\n", msg.Value)
-		}
-		result, err = client.HSet(cmd.Key, cmd.Field, msg.Value).Result()
-		if err != nil {
-			return result, err
+	msg = msg[i+len(marker):]
+	if j := strings.IndexByte(msg, ')'); j >= 0 {
+		if offset, err := strconv.ParseInt(msg[:j], 10, 64); err == nil {
+			return offset
 		}
-	case "PREVIOUS_VALUE":
-		if conf.Main.Debug {
-			log.Printf("[Hset] value(previos value): %v\n", previousValue)
-		}
-		result, err = client.HSet(cmd.Key, cmd.Field, previousValue).Result()
-		if err != nil {
-			return result, err
-		}
-	case "VALUE":
-		if conf.Main.Debug {
-			log.Printf("[Hset] value(value): %s\n", cmd.Value)
-		}
-		result, err = client.HSet(cmd.Key, cmd.Field, cmd.Value).Result()
-		if err != nil {
-			return result, err
-		}
-	default:
-		log.Printf("[Hset] command no match: %s\n", cmd.From)
-	}
-	if conf.Main.Debug {
-		log.Printf("[Hset] result: %v\n", result)
 	}
-	return result, nil
+	return fallback
 }
 
-// ExecSets ...
-func ExecSets(conf Config, client *redis.Client, cmd *Command, msg *kafka.Message, previousValue interface{}) (interface{}, error) {
-	var result interface{}
-	var err error
-	if conf.Main.Debug {
-		log.Printf("[Set] key: %s\n", cmd.Key)
+// executeLeased is executeBatch fenced by lease, which may be nil. When a
+// message cannot be applied it returns an *applyError with the offset of
+// that message: the messages before it are applied and it left nothing
+// behind.
+func executeLeased(conf Config, client storage.Store, lease *Lease, batch []pendingMessage) error {
+	first, last := batch[0].msg, batch[len(batch)-1].msg
+	keys := []string{OFFSET_KEY, leaseKey(first.Topic, first.Partition)}
+	fence := ""
+	if lease != nil {
+		fence = lease.value()
 	}
-	switch (*cmd).From {
-	case "SELF":
-		if conf.Main.Debug {
-			log.Printf("[Set] value(self): %s\n", msg.Value)
-		}
-		result, err = client.Set(cmd.Key, msg.Value, 0).Result()
-		if err != nil {
-			return result, err
-		}
-	case "PREVIOUS_VALUE":
-		if conf.Main.Debug {
-			log.Printf("[Set] value(previos value): %v\n", previousValue)
-		}
-		result, err = client.Set(cmd.Key, previousValue, 0).Result()
-		if err != nil {
-			return result, err
+	args := []interface{}{offsetField(first.Topic, first.Partition), conf.Dedup.Window, len(batch), fence, conf.Ledisdb.Dialect, snapshotLimit(conf)}
+	for i, p := range batch {
+		applied := ""
+		if p.id != "" && conf.Dedup.Window > 0 {
+			applied = appliedKey(p.msg.Topic, p.id)
 		}
-	case "VALUE":
-		if conf.Main.Debug {
-			log.Printf("[Set] value(value): %s\n", cmd.Value)
+		args = append(args, p.msg.Offset, p.msg.Value, applied, len(p.cmds))
+		for _, cmd := range p.cmds {
+			if conf.Main.Debug {
+				log.Printf("[ledisdb] cmd: %s, key: %s, field: %s, from: %s, value: %s, ttl: %d, score: %v\n", cmd.Group, cmd.Key, cmd.Field, cmd.From, cmd.Value, cmd.TTL, cmd.Score)
+			}
+			if err := ValidateCommand(&cmd); err != nil {
+				return rejectMessage(conf, client, lease, batch, i, err)
+			}
+			group, _ := LookupGroup(cmd.Group)
+			keys = append(keys, cmd.Key)
+			args = append(args, cmd.Group, cmd.Field, cmd.From, cmd.Value, commandTTL(conf, &cmd), expireCommand(conf, group.Type), cmd.Score, cmd.As)
 		}
-		result, err = client.Set(cmd.Key, cmd.Value, 0).Result()
-		if err != nil {
-			return result, err
+		if err := ValidateRefs(p.cmds); err != nil {
+			return rejectMessage(conf, client, lease, batch, i, err)
 		}
-	default:
-		log.Printf("[Set] command no match: %s\n", cmd.From)
-	}
-	if conf.Main.Debug {
-		log.Printf("[Set] result: %v\n", result)
 	}
-	return result, nil
-}
-
-// ExecuteLedisCmds ...
-func ExecuteLedisCmds(conf Config, client *redis.Client, cmds *[]Command, msg *kafka.Message) error {
-	var result interface{}
+	var reply interface{}
 	var err error
-	for _, cmd := range *cmds {
-		if conf.Main.Debug {
-			log.Printf("[ledisdb] cmd: %s\n", cmd.Group)
+	for attempt := 0; ; attempt++ {
+		reply, err = client.Eval(applyScriptCmd(), keys, args...)
+		if err == nil || !isTransient(err) || attempt >= conf.Ledisdb.Retry {
+			break
 		}
-		switch cmd.Group {
-		case "LISTS":
-			result, err = ExecList(conf, client, &cmd, msg, result)
-			if err != nil {
-				return err
-			}
-		case "HASHES":
-			result, err = ExecHash(conf, client, &cmd, msg, result)
-			if err != nil {
-				return err
-			}
-		case "SETS":
-			result, err = ExecSets(conf, client, &cmd, msg, result)
-			if err != nil {
-				return err
-			}
-    case "ZINCRBY":
-			if conf.Main.Debug {
-				log.Printf("[ZINCRBY] key: %s, value(value):%s\n", cmd.Key, cmd.Value)
-			}
-
-			result, err = client.ZIncrBy(cmd.Key, 1, cmd.Value).Result()
-			if err != nil {
-				return err
-			}
-			if conf.Main.Debug {
-				log.Printf("[ZIncrBy] result: %v\n", result)
-			}
-		case "ZADD":
-			if conf.Main.Debug {
-				log.Printf("[ZAdd] key: %s, score 1, value(value):%s\n", cmd.Key, cmd.Value)
-			}
-
-			result, err = client.ZAdd(cmd.Key, redis.Z{Score: float64(1), Member: cmd.Value}).Result()
-
-			if err != nil {
-				return err
+		log.Printf("[ledisdb] retry apply (offset=%d-%d, attempt=%d): %v\n", first.Offset, last.Offset, attempt+1, err)
+		time.Sleep(time.Duration(conf.Ledisdb.RetryWait) * time.Millisecond << uint(attempt))
+	}
+	if err != nil {
+		return &applyError{Offset: failedOffset(err, first.Offset), Err: err}
+	}
+	statuses, _ := reply.([]interface{})
+	applied, duplicates := 0, 0
+	for i, status := range statuses {
+		switch status {
+		case int64(MESSAGE_APPLIED):
+			applied++
+			for _, cmd := range batch[i].cmds {
+				commandsExecuted.WithLabelValues(cmd.Group).Inc()
 			}
+		case int64(MESSAGE_DUPLICATE):
+			duplicates++
+			duplicatesSkipped.WithLabelValues(first.Topic).Inc()
 			if conf.Main.Debug {
-				log.Printf("[ZAdd] result: %v\n", result)
+				log.Printf("[ledisdb] skip duplicate %s (offset=%d)\n", batch[i].id, batch[i].msg.Offset)
 			}
 		}
 	}
+	if conf.Main.Debug {
+		log.Printf("[ledisdb] offset: %d-%d, applied: %d/%d, duplicates: %d\n", first.Offset, last.Offset, applied, len(batch), duplicates)
+	}
 	return nil
 }
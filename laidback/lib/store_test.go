@@ -0,0 +1,300 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/storage"
+)
+
+// TestExecuteLedisCmds ...
+func TestExecuteLedisCmds(t *testing.T) {
+	client := storage.NewMemory("TestExecuteLedisCmds", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis"}, TTLs: []TTLConfig{{Prefix: "subject:", TTL: 60}}}
+	cmds := []Command{
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF},
+		{Group: "HASHES", Key: "subject:news", Field: "Inverted:x", From: FROM_PREVIOUS_VALUE},
+		{Group: "ZADD", Key: "subject:news", From: FROM_VALUE, Value: "x", Score: 1527209139},
+	}
+	msg := kafka.Message{Topic: "roure.avro.subject", Partition: 0, Offset: 5, Value: []byte("payload")}
+	// the second apply is fenced off by the stored offset
+	for i := 0; i < 2; i++ {
+		if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := client.LLen("subject:news"); n != 1 {
+		t.Fatalf("llen %d, want 1", n)
+	}
+	if pos, _ := client.HGet("subject:news", "Inverted:x"); pos != "1" {
+		t.Fatalf("index %s, want 1", pos)
+	}
+	if offset, _ := Offset(client, msg.Topic, msg.Partition); offset != 6 {
+		t.Fatalf("offset %d, want 6", offset)
+	}
+
+	cmds = []Command{{Group: "UNKNOWN", Key: "k", From: FROM_VALUE}}
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err == nil {
+		t.Fatal("unknown group accepted")
+	}
+}
+
+// TestExecuteBatch ...
+func TestExecuteBatch(t *testing.T) {
+	client := storage.NewMemory("TestExecuteBatch", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis"}}
+	batch := []pendingMessage{}
+	for i, id := range []string{"a", "b", "b"} {
+		batch = append(batch, pendingMessage{
+			msg: &kafka.Message{Topic: "roure.avro.comment", Partition: 1, Offset: int64(10 + i), Value: []byte(id)},
+			cmds: []Command{
+				{Group: "LISTS", Key: "comment:x", From: FROM_SELF},
+				{Group: "HASHES", Key: "comment:x", Field: id, From: FROM_PREVIOUS_VALUE},
+			},
+		})
+	}
+	// offset 12 is already stored before the batch is applied twice
+	if err := SetOffset(client, "roure.avro.comment", 1, 12); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := executeBatch(conf, client, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if items, _ := client.LRange("comment:x", 0, -1); len(items) != 1 || items[0] != "b" {
+		t.Fatalf("list %v, want [b]", items)
+	}
+
+	client = storage.NewMemory("TestExecuteBatch", 1)
+	if err := executeBatch(conf, client, batch[:2]); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"a": "1", "b": "2"} {
+		if pos, _ := client.HGet("comment:x", id); pos != want {
+			t.Fatalf("index of %s %s, want %s", id, pos, want)
+		}
+	}
+	if offset, _ := Offset(client, "roure.avro.comment", 1); offset != 12 {
+		t.Fatalf("offset %d, want 12", offset)
+	}
+
+	// a failing message keeps the ones before it
+	registerTestGroup(t, CommandGroup{Name: "TEST_FAIL", Froms: []string{FROM_VALUE}, Script: `return redis.call('NOSUCHCOMMAND', key)`})
+	batch[1].cmds = []Command{{Group: "LISTS", Key: "comment:x", From: FROM_SELF}, {Group: "TEST_FAIL", Key: "comment:x", From: FROM_VALUE}}
+	client = storage.NewMemory("TestExecuteBatch", 2)
+	if err := executeBatch(conf, client, batch[:2]); err == nil {
+		t.Fatal("failing batch applied")
+	}
+	if offset, _ := Offset(client, "roure.avro.comment", 1); offset != 11 {
+		t.Fatalf("offset %d, want 11", offset)
+	}
+	if items, _ := client.LRange("comment:x", 0, -1); len(items) != 1 || items[0] != "a" {
+		t.Fatalf("list %v, want [a]", items)
+	}
+}
+
+// TestExecuteRollback ...
+func TestExecuteRollback(t *testing.T) {
+	client := storage.NewMemory("TestExecuteRollback", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis"}, TTLs: []TTLConfig{{Prefix: "comment:", TTL: 60}}}
+	registerTestGroup(t, CommandGroup{
+		Name:  "TEST_WRITE_FAIL",
+		Froms: []string{FROM_VALUE},
+		Script: `redis.call('RPUSH', key, 'half')
+return redis.call('NOSUCHCOMMAND', key)`,
+	})
+	cmds := []Command{
+		{Group: "LISTS", Key: "comment:x", From: FROM_VALUE, Value: "c0"},
+		{Group: "HASHES", Key: "comment:x", Field: "f", From: FROM_VALUE, Value: "old"},
+		{Group: "ZADD", Key: "favs:x", From: FROM_VALUE, Value: "c0", Score: 5},
+	}
+	msg := kafka.Message{Topic: "roure.avro.comment", Value: []byte("c1")}
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// every command writes before the last one fails
+	cmds = []Command{
+		{Group: "LISTS", Key: "comment:x", From: FROM_SELF},
+		{Group: "HASHES", Key: "comment:x", Field: "f", From: FROM_PREVIOUS_VALUE},
+		{Group: "HASHES", Key: "comment:x", Field: "g", From: FROM_VALUE, Value: "new"},
+		{Group: "ZINCRBY", Key: "favs:x", From: FROM_VALUE, Value: "c0", Score: 1},
+		{Group: "ZADD", Key: "favs:x", From: FROM_VALUE, Value: "c1", Score: 1},
+		{Group: "DEL", Key: "favs:x", From: FROM_VALUE},
+		{Group: "TEST_WRITE_FAIL", Key: "comment:x", From: FROM_VALUE},
+	}
+	msg.Offset++
+	err := ExecuteLedisCmds(conf, client, &cmds, &msg)
+	if err == nil || !strings.Contains(err.Error(), "apply error (offset=1)") {
+		t.Fatalf("apply error %v", err)
+	}
+	if items, _ := client.LRange("comment:x", 0, -1); len(items) != 1 || items[0] != "c0" {
+		t.Fatalf("list %v, want [c0]", items)
+	}
+	if hash, _ := client.HGetAll("comment:x"); len(hash) != 1 || hash["f"] != "old" {
+		t.Fatalf("hash %v, want f=old", hash)
+	}
+	if zs, _ := client.ZRangeWithScores("favs:x", 0, -1); len(zs) != 1 || zs[0].Member != "c0" || zs[0].Score != 5 {
+		t.Fatalf("favs %v, want [c0 5]", zs)
+	}
+	if offset, _ := Offset(client, msg.Topic, msg.Partition); offset != 1 {
+		t.Fatalf("offset %d, want 1", offset)
+	}
+}
+
+// TestExecuteRollbackCopies ...
+func TestExecuteRollbackCopies(t *testing.T) {
+	client := storage.NewMemory("TestExecuteRollbackCopies", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis", SnapshotLimit: 2}, TTLs: []TTLConfig{{Prefix: "comment:", TTL: 60}}}
+	registerTestGroup(t, CommandGroup{
+		Name:   "TEST_COPY_FAIL",
+		Froms:  []string{FROM_VALUE},
+		Script: `return redis.call('NOSUCHCOMMAND', key)`,
+	})
+	cmds := []Command{
+		{Group: "LISTS", Key: "comment:small", From: FROM_VALUE, Value: "c0"},
+		{Group: "LISTS", Key: "comment:large", From: FROM_VALUE, Value: "c0"},
+		{Group: "LISTS", Key: "comment:large", From: FROM_VALUE, Value: "c1"},
+		{Group: "LISTS", Key: "comment:large", From: FROM_VALUE, Value: "c2"},
+	}
+	msg := kafka.Message{Topic: "roure.avro.comment", Value: []byte("c")}
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err != nil {
+		t.Fatal(err)
+	}
+	ttl := storage.NewScript(`return redis.call('LTTL', KEYS[1])`)
+
+	// a deleted key comes back with its TTL
+	cmds = []Command{
+		{Group: "DEL", Key: "comment:small", From: FROM_VALUE},
+		{Group: "TEST_COPY_FAIL", Key: "comment:small", From: FROM_VALUE},
+	}
+	msg.Offset++
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err == nil || strings.Contains(err.Error(), "undo failed") {
+		t.Fatalf("apply error %v", err)
+	}
+	if items, _ := client.LRange("comment:small", 0, -1); len(items) != 1 || items[0] != "c0" {
+		t.Fatalf("list %v, want [c0]", items)
+	}
+	if n, _ := storage.Int64(client.Eval(ttl, []string{"comment:small"})); n <= 0 {
+		t.Fatalf("ttl %d after restore", n)
+	}
+
+	// a key over the limit is not copied and can't be put back
+	cmds = []Command{
+		{Group: "DEL", Key: "comment:large", From: FROM_VALUE},
+		{Group: "TEST_COPY_FAIL", Key: "comment:large", From: FROM_VALUE},
+	}
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err == nil || !strings.Contains(err.Error(), "undo failed") {
+		t.Fatalf("apply error %v", err)
+	}
+}
+
+// TestExecuteBatchDedup ...
+func TestExecuteBatchDedup(t *testing.T) {
+	client := storage.NewMemory("TestExecuteBatchDedup", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis"}, Dedup: DedupConfig{Window: 60, Field: "id"}}
+	cmds := []Command{{Group: "ZINCRBY", Key: "views:news", From: FROM_VALUE, Value: "x", Score: 1}}
+	batch := []pendingMessage{}
+	// the same event replayed at a later offset, e.g. after a rollback
+	for offset := int64(0); offset < 3; offset++ {
+		batch = append(batch, pendingMessage{msg: &kafka.Message{Topic: "roure.avro.activity", Offset: offset}, cmds: cmds, id: "evt1"})
+	}
+	if err := executeBatch(conf, client, batch[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := executeBatch(conf, client, batch[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if views, _ := client.ZRangeWithScores("views:news", 0, -1); len(views) != 1 || views[0].Score != 1 {
+		t.Fatalf("views %v, want x counted once", views)
+	}
+	if offset, _ := Offset(client, "roure.avro.activity", 0); offset != 3 {
+		t.Fatalf("offset %d, want 3", offset)
+	}
+}
+
+// TestExecuteNamedResults ...
+func TestExecuteNamedResults(t *testing.T) {
+	client := storage.NewMemory("TestExecuteNamedResults", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis"}}
+	// one list position kept in two indexes, with a command in between
+	cmds := []Command{
+		{Group: "LISTS", Key: "subject:news", From: FROM_SELF, As: "pos"},
+		{Group: "ZADD", Key: "subject:news", From: FROM_VALUE, Value: "x", Score: 1},
+		{Group: "HASHES", Key: "subject:news", Field: "Inverted:x", From: FROM_RESULT, Value: "pos"},
+		{Group: "HASHES", Key: "subject:byname", Field: "hello", From: FROM_RESULT, Value: "pos"},
+	}
+	msg := kafka.Message{Topic: "roure.avro.subject", Value: []byte("payload")}
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err != nil {
+		t.Fatal(err)
+	}
+	for key, field := range map[string]string{"subject:news": "Inverted:x", "subject:byname": "hello"} {
+		if pos, _ := client.HGet(key, field); pos != "1" {
+			t.Fatalf("%s %s = %q, want 1", key, field, pos)
+		}
+	}
+
+	cmds = []Command{{Group: "HASHES", Key: "k", Field: "f", From: FROM_RESULT, Value: "pos"}}
+	msg.Offset++
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err == nil {
+		t.Fatal("unknown result accepted")
+	}
+}
+
+// TestExecuteScript ...
+func TestExecuteScript(t *testing.T) {
+	client := storage.NewMemory("TestExecuteScript", 0)
+	conf := Config{Ledisdb: LedisdbConfig{Dialect: "ledis"}}
+	// KEYS[2] is the key of the first command of the message
+	favIfExists := `if redis.call('HEXISTS', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+return redis.call('ZINCRBY', KEYS[1], ARGV[2], ARGV[1])`
+	registerTestScript(t, "test_fav_if_exists", favIfExists)
+	registerTestScript(t, "test_refuse", `redis.call('ZADD', KEYS[1], 1, ARGV[3])
+return redis.error_reply('refused ' .. KEYS[1])`)
+	if err := LoadScripts(client); err != nil {
+		t.Fatal(err)
+	}
+	cmds := []Command{
+		{Group: "HASHES", Key: "comment:x", Field: "c1", From: FROM_VALUE, Value: "0"},
+		{Group: GROUP_SCRIPT, Key: "favs:x", Field: "test_fav_if_exists", From: FROM_VALUE, Value: "c1", Score: 2, As: "favs"},
+		{Group: GROUP_SCRIPT, Key: "favs:x", Field: "test_fav_if_exists", From: FROM_VALUE, Value: "c2", Score: 2},
+		{Group: "HASHES", Key: "comment:x", Field: "c1", From: FROM_RESULT, Value: "favs"},
+	}
+	msg := kafka.Message{Topic: "roure.avro.activity", Value: []byte("payload")}
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if zs, _ := client.ZRangeWithScores("favs:x", 0, -1); len(zs) != 1 || zs[0].Member != "c1" || zs[0].Score != 2 {
+		t.Fatalf("favs %v, want [c1 2]", zs)
+	}
+	if v, _ := client.HGet("comment:x", "c1"); v != "2" {
+		t.Fatalf("script result %q, want 2", v)
+	}
+
+	// the writes of a failing script and the commands before it are reverted
+	cmds = []Command{
+		{Group: "LISTS", Key: "comment:x", From: FROM_SELF},
+		{Group: GROUP_SCRIPT, Key: "favs:x", Field: "test_refuse", From: FROM_VALUE},
+	}
+	msg.Offset++
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err == nil || !strings.Contains(err.Error(), "refused favs:x") {
+		t.Fatalf("script error %v", err)
+	}
+	if zs, _ := client.ZRangeWithScores("favs:x", 0, -1); len(zs) != 1 || zs[0].Member != "c1" {
+		t.Fatalf("favs %v after failed script, want [c1 2]", zs)
+	}
+	if n, _ := client.LLen("comment:x"); n != 0 {
+		t.Fatalf("list length %d after failed script, want 0", n)
+	}
+	if offset, _ := Offset(client, msg.Topic, msg.Partition); offset != 1 {
+		t.Fatalf("offset %d after failed script, want 1", offset)
+	}
+	cmds[0].Field = "test_missing"
+	if err := ExecuteLedisCmds(conf, client, &cmds, &msg); err == nil {
+		t.Fatal("unknown script accepted")
+	}
+}
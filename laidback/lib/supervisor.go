@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ReaderState string
+
+const (
+	READER_RUNNING ReaderState = "running"
+	READER_BACKOFF ReaderState = "backing off"
+	READER_FAILED  ReaderState = "failed"
+	READER_STOPPED ReaderState = "stopped"
+)
+
+type ReaderStatus struct {
+	Topic     string      `json:"topic"`
+	Partition int         `json:"partition"`
+	State     ReaderState `json:"state"`
+	Restarts  int         `json:"restarts"`
+	LastError string      `json:"last_error"`
+	Since     time.Time   `json:"since"`
+}
+
+// Supervisor restarts failed partition readers with exponential backoff
+// and keeps the state of every reader it runs.
+type Supervisor struct {
+	conf   SupervisorConfig
+	mu     sync.Mutex
+	status map[string]*ReaderStatus
+	wg     sync.WaitGroup
+}
+
+// NewSupervisor ...
+func NewSupervisor(conf Config) *Supervisor {
+	return &Supervisor{conf: conf.Supervisor, status: map[string]*ReaderStatus{}}
+}
+
+// setState ...
+func (s *Supervisor) setState(topic string, partition int, state ReaderState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := offsetField(topic, partition)
+	st, ok := s.status[name]
+	if !ok {
+		st = &ReaderStatus{Topic: topic, Partition: partition}
+		s.status[name] = st
+	}
+	if state == READER_BACKOFF {
+		st.Restarts++
+	}
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	st.State = state
+	st.Since = time.Now()
+	log.Printf("[supervisor] %s %s (restarts: %d, last error: %s)\n", name, st.State, st.Restarts, st.LastError)
+}
+
+// backoff ...
+func (s *Supervisor) backoff(failures int) time.Duration {
+	min := time.Duration(s.conf.BackoffMin) * time.Second
+	max := time.Duration(s.conf.BackoffMax) * time.Second
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	wait := min
+	for i := 1; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// Go runs fn for a topic partition until ctx is done, restarting it with
+// exponential backoff whenever it returns an error.
+func (s *Supervisor) Go(ctx context.Context, topic string, partition int, fn func(ctx context.Context) error) {
+	s.setState(topic, partition, READER_RUNNING, nil)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		failures := 0
+		for {
+			started := time.Now()
+			err := fn(ctx)
+			if ctx.Err() != nil {
+				s.setState(topic, partition, READER_STOPPED, nil)
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("reader returned")
+			}
+			if time.Since(started) > s.backoff(failures+1) {
+				failures = 0
+			}
+			failures++
+			if s.conf.MaxRestarts > 0 && failures > s.conf.MaxRestarts {
+				s.setState(topic, partition, READER_FAILED, err)
+				return
+			}
+			s.setState(topic, partition, READER_BACKOFF, err)
+			select {
+			case <-ctx.Done():
+				s.setState(topic, partition, READER_STOPPED, nil)
+				return
+			case <-time.After(s.backoff(failures)):
+			}
+			s.setState(topic, partition, READER_RUNNING, nil)
+		}
+	}()
+}
+
+// Has reports whether a reader for the topic partition was started.
+func (s *Supervisor) Has(topic string, partition int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.status[offsetField(topic, partition)]
+	return ok
+}
+
+// Status ...
+func (s *Supervisor) Status() []ReaderStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := []ReaderStatus{}
+	for _, st := range s.status {
+		status = append(status, *st)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Topic != status[j].Topic {
+			return status[i].Topic < status[j].Topic
+		}
+		return status[i].Partition < status[j].Partition
+	})
+	return status
+}
+
+// Monitor logs the state of every reader each interval until ctx is done.
+func (s *Supervisor) Monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, st := range s.Status() {
+				log.Printf("[supervisor] %s:%d %s since %s (restarts: %d, last error: %s)\n", st.Topic, st.Partition, st.State, st.Since.Format(time.RFC3339), st.Restarts, st.LastError)
+			}
+		}
+	}
+}
+
+// Wait ...
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
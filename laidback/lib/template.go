@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// templateField matches a {name} placeholder. Dotted names reach into
+// nested records, e.g. {opengraph.sitename}. Braces around anything else
+// are left alone.
+var templateField = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)\}`)
+
+// recordField looks up a dotted field name in a decoded Avro record.
+func recordField(record map[string]interface{}, name string) (interface{}, bool) {
+	var v interface{} = record
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	// goavro wraps non null union values as map[type]value
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		for _, inner := range m {
+			v = inner
+		}
+	}
+	return v, true
+}
+
+// templateValue ...
+func templateValue(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	case int32:
+		return strconv.FormatInt(int64(t), 10), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	}
+	return "", false
+}
+
+// resolveTemplate replaces every {name} in s with the named field of the
+// record, so producers can send subject:{category} instead of the key.
+func resolveTemplate(s string, record map[string]interface{}) (string, error) {
+	var err error
+	resolved := templateField.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		v, ok := recordField(record, name)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("template %s: field %s not found", s, name)
+			}
+			return placeholder
+		}
+		str, ok := templateValue(v)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("template %s: field %s is not a scalar", s, name)
+			}
+			return placeholder
+		}
+		return str
+	})
+	return resolved, err
+}
@@ -2,39 +2,55 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"os/signal"
+	"syscall"
 
-	"github.com/go-redis/redis"
-	"github.com/linkedin/goavro"
+	kafka "github.com/segmentio/kafka-go"
 	"github.com/yasukun/roure/laidback/lib"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
 )
 
 // Usage ...
 func Usage() {
 	fmt.Fprint(os.Stderr, "Usage of ", os.Args[0], ":\n")
 	flag.PrintDefaults()
+	fmt.Fprint(os.Stderr, "\nCommands:\n")
+	fmt.Fprint(os.Stderr, "  dlq replay [topic...]\tre-inject dead letters into their original topics\n")
+	fmt.Fprint(os.Stderr, "  rebuild\t\treplay all topics into the rebuild db and swap it live\n")
+	fmt.Fprint(os.Stderr, "  explain [-json] [-offline] [-n count] [-offset n] [-partition p] topic\n\t\t\tprint what messages would write, only reading ledis\n")
 	fmt.Fprint(os.Stderr, "\n")
 }
 
 type Codecs struct {
-	Conf lib.Config
+	Conf     lib.Config
+	Registry *avroreg.Client
 }
 
 // (c Codecs) Get ...
-func (c Codecs) Get(topicName string) (*goavro.Codec, error) {
-	var codec *goavro.Codec
+func (c Codecs) Get(topicName string) (*avroreg.Codec, error) {
+	var codec *avroreg.Codec
 	for _, topic := range c.Conf.Kafka.Topics {
 		if topic.Topic == topicName {
 			schema, err := Asset(topic.AvroSchema)
 			if err != nil {
 				return codec, err
 			}
-			codec, err = goavro.NewCodec(string(schema))
+			var unframed []byte
+			if topic.UnframedSchema != "" {
+				if unframed, err = Asset(topic.UnframedSchema); err != nil {
+					return codec, err
+				}
+			}
+			codec, err = avroreg.NewCodec(c.Registry, string(schema), string(unframed))
 			if err != nil {
 				return codec, err
 			}
@@ -45,6 +61,117 @@ func (c Codecs) Get(topicName string) (*goavro.Codec, error) {
 	return codec, fmt.Errorf("schema(%s) not found", topicName)
 }
 
+// contains ...
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// replayDeadLetters ...
+func replayDeadLetters(conf lib.Config, client storage.Store, targets []string) error {
+	ctx := context.Background()
+	for _, topic := range conf.Kafka.Topics {
+		if topic.DeadLetter == "" {
+			continue
+		}
+		if len(targets) > 0 && !contains(targets, topic.Topic) {
+			continue
+		}
+		n, err := lib.ReplayDeadLetter(ctx, conf, client, topic)
+		log.Printf("replay dead letter (%s -> %s): %d messages\n", topic.DeadLetter, topic.Topic, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuild ...
+func rebuild(conf lib.Config, client storage.Store, codecs Codecs) error {
+	topicCodecs := map[string]*avroreg.Codec{}
+	for _, topic := range conf.Kafka.Topics {
+		codec, err := codecs.Get(topic.Topic)
+		if err != nil {
+			return err
+		}
+		topicCodecs[topic.Topic] = codec
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		cancel()
+	}()
+	return lib.Rebuild(ctx, conf, client, topicCodecs)
+}
+
+// explain ...
+func explain(conf lib.Config, codecs Codecs, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	count := fs.Int("n", 0, "messages per partition, 0 follows the topic")
+	offset := fs.Int64("offset", kafka.FirstOffset, "start offset (-2 first, -1 last)")
+	partition := fs.Int("partition", -1, "partition, -1 for all")
+	offline := fs.Bool("offline", false, "do not read ledis, leave command results unresolved")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("explain needs a topic")
+	}
+	var topic lib.TopicConfig
+	for _, t := range conf.Kafka.Topics {
+		if t.Topic == fs.Arg(0) {
+			topic = t
+		}
+	}
+	codec, err := codecs.Get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	opts := lib.ExplainOptions{Offset: *offset, Count: *count, JSON: *asJSON}
+	if *partition >= 0 {
+		opts.Partitions = []int{*partition}
+	}
+	// results are predicted from ledis when it can be reached
+	var client storage.Store
+	if !*offline {
+		if client, err = lib.OpenStore(conf, conf.Ledisdb.DB); err == nil {
+			defer client.Close()
+			err = client.Ping()
+		}
+		if err != nil {
+			log.Printf("explain: ledisdb not read, results stay unresolved: %v\n", err)
+			client = nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		cancel()
+	}()
+	return lib.ExplainTopic(ctx, conf, client, codec, topic, opts, os.Stdout)
+}
+
+// runCommand ...
+func runCommand(conf lib.Config, client storage.Store, codecs Codecs, args []string) error {
+	switch {
+	case len(args) >= 2 && args[0] == "dlq" && args[1] == "replay":
+		return replayDeadLetters(conf, client, args[2:])
+	case len(args) == 1 && args[0] == "rebuild":
+		return rebuild(conf, client, codecs)
+	}
+	Usage()
+	return fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+}
+
 func main() {
 	flag.Usage = Usage
 	confname := flag.String("c", "laidback.toml", "path to config")
@@ -60,48 +187,130 @@ func main() {
 		log.Fatalln("decode config error", err)
 	}
 
+	if err := lib.RegisterScripts(conf); err != nil {
+		log.Fatalln("register script error: ", err)
+	}
+
+	if conf.Main.AuditLog != "" {
+		if err := lib.OpenAuditLog(conf.Main.AuditLog); err != nil {
+			log.Fatalln("open audit log error: ", err)
+		}
+	}
+
 	codecs := Codecs{Conf: conf}
+	if conf.Registry.URL != "" {
+		codecs.Registry = avroreg.NewClient(conf.Registry.URL)
+	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr:     conf.Ledisdb.Addr,
-		Password: conf.Ledisdb.Password,
-		DB:       conf.Ledisdb.DB,
-	})
+	// explain only reads ledis
+	if flag.NArg() > 0 && flag.Arg(0) == "explain" {
+		if err := explain(conf, codecs, flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
 
-	pong, err := client.Ping().Result()
+	client, err := lib.OpenStore(conf, conf.Ledisdb.DB)
 	if err != nil {
+		log.Fatalln("open storage error: ", err)
+	}
+
+	if err := client.Ping(); err != nil {
 		log.Fatalln("ledisdb ping: ", err)
 	}
-	log.Printf("ledisdb ping: %s", pong)
+	log.Printf("ledisdb ping: PONG (backend: %s)", conf.Ledisdb.Backend)
+
+	if err := lib.LoadScripts(client); err != nil {
+		log.Fatalln(err)
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(conf, client, codecs, flag.Args()); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+
 	log.Println("laidback start")
 
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
+	supervisor := lib.NewSupervisor(conf)
+	topicCodecs := map[string]*avroreg.Codec{}
 	for _, topic := range conf.Kafka.Topics {
-		for i := 0; i < topic.Partitions; i++ {
-			if err := lib.SetOffsetNX(client, topic.Topic, i); err != nil {
-				log.Printf("set offset if not exist error (topic=%s): %v\n", topic.Topic, err)
+		codec, err := codecs.Get(topic.Topic)
+		if err != nil {
+			log.Fatalln("take codec error: ", err)
+		}
+		topicCodecs[topic.Topic] = codec
+	}
+	start := func(ctx context.Context, topic lib.TopicConfig, partition int) {
+		log.Printf("  spawn listener (topic: %s partition: %d)\n", topic.Topic, partition)
+		codec := topicCodecs[topic.Topic]
+		supervisor.Go(ctx, topic.Topic, partition, func(ctx context.Context) error {
+			if err := lib.SetOffsetNX(client, topic.Topic, partition); err != nil {
+				return fmt.Errorf("set offset if not exist error (topic=%s): %v", topic.Topic, err)
 			}
-			go func(ctx context.Context, conf lib.Config, client *redis.Client, topic lib.TopicConfig, partition int) {
-				log.Printf("  spawn listener (topic: %s partition: %d)\n", topic.Topic, partition)
-				codec, err := codecs.Get(topic.Topic)
-				if err != nil {
-					log.Fatalln("take codec error: ", err)
-				}
-				if err := lib.ReadKafka(ctx, conf, client, codec, topic, partition); err != nil {
-					log.Printf("kafka read error: %v\n", err)
+			if err := lib.ReadKafka(ctx, conf, client, codec, topic, partition); err != nil {
+				return fmt.Errorf("kafka read error: %v", err)
+			}
+			return nil
+		})
+	}
+	if conf.Kafka.GroupID != "" {
+		// the group assigns partitions, one reader per topic (partition -1)
+		for _, topic := range conf.Kafka.Topics {
+			log.Printf("  spawn group listener (topic: %s group: %s)\n", topic.Topic, conf.Kafka.GroupID)
+			topic, codec := topic, topicCodecs[topic.Topic]
+			supervisor.Go(ctx, topic.Topic, -1, func(ctx context.Context) error {
+				if err := lib.ReadKafkaGroup(ctx, conf, client, codec, topic); err != nil {
+					return fmt.Errorf("kafka group read error: %v", err)
 				}
-			}(ctx, conf, client, topic, i)
+				return nil
+			})
+		}
+	} else {
+		lib.SyncPartitions(ctx, conf, supervisor, true, start)
+		if conf.Kafka.DiscoveryInterval > 0 {
+			go lib.WatchPartitions(ctx, conf, supervisor, time.Duration(conf.Kafka.DiscoveryInterval)*time.Second, start)
 		}
 	}
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
+	if conf.Metrics.Addr != "" {
+		go func() {
+			if err := lib.ServeMetrics(conf.Metrics.Addr); err != nil {
+				log.Printf("metrics server error: %v\n", err)
+			}
+		}()
+		if conf.Metrics.LagInterval > 0 {
+			go lib.WatchLag(ctx, conf, client, time.Duration(conf.Metrics.LagInterval)*time.Second)
+		}
+	}
+	if conf.Supervisor.StatusInterval > 0 {
+		go supervisor.Monitor(ctx, time.Duration(conf.Supervisor.StatusInterval)*time.Second)
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
+	log.Println("laidback draining")
 	cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		supervisor.Wait()
+		close(drained)
+	}()
 	select {
-	case <-ctx.Done():
-		log.Println("laidback stop:", ctx.Err())
+	case <-drained:
+	case <-quit:
+		log.Println("laidback stop: interrupted while draining")
+		os.Exit(1)
+	case <-time.After(time.Duration(conf.Main.ShutdownTimeout) * time.Second):
+		log.Println("laidback stop: drain timed out")
+		os.Exit(1)
 	}
-
+	if err := client.Close(); err != nil {
+		log.Println("ledisdb close error: ", err)
+	}
+	log.Println("laidback stop")
 	os.Exit(0)
 }
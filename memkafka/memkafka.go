@@ -0,0 +1,187 @@
+// Package memkafka is an in-process stand-in for the Kafka topics middleton
+// produces to and laidback reads from. Brokers are looked up by name, so a
+// producer and a reader configured with the same broker address in one
+// process share their topics.
+package memkafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const (
+	BACKEND_KAFKA  = "kafka"
+	BACKEND_MEMORY = "memory"
+)
+
+// Broker keeps every partition of its topics in memory.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string][][]kafka.Message
+	// notify is closed and replaced whenever messages are written
+	notify chan struct{}
+}
+
+var brokers = struct {
+	sync.Mutex
+	named map[string]*Broker
+}{named: map[string]*Broker{}}
+
+// Named returns the broker called name, creating it on first use.
+func Named(name string) *Broker {
+	brokers.Lock()
+	defer brokers.Unlock()
+	b, ok := brokers.named[name]
+	if !ok {
+		b = &Broker{topics: map[string][][]kafka.Message{}, notify: make(chan struct{})}
+		brokers.named[name] = b
+	}
+	return b
+}
+
+// CreateTopic creates topic with the given number of partitions, or adds
+// partitions to an existing topic that has fewer.
+func (b *Broker) CreateTopic(topic string, partitions int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.topics[topic]) < partitions {
+		b.topics[topic] = append(b.topics[topic], []kafka.Message{})
+	}
+}
+
+// Partitions ...
+func (b *Broker) Partitions(topic string) ([]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	partitions, ok := b.topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("unknown topic: %s", topic)
+	}
+	ids := []int{}
+	for id := range partitions {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LastOffset returns the offset the next message of partition will get.
+func (b *Broker) LastOffset(topic string, partition int) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log, err := b.partition(topic, partition)
+	if err != nil {
+		return -1, err
+	}
+	return int64(len(log)), nil
+}
+
+// partition ... The caller holds mu.
+func (b *Broker) partition(topic string, partition int) ([]kafka.Message, error) {
+	partitions, ok := b.topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("unknown topic: %s", topic)
+	}
+	if partition < 0 || partition >= len(partitions) {
+		return nil, fmt.Errorf("unknown partition: %s/%d", topic, partition)
+	}
+	return partitions[partition], nil
+}
+
+// WriteMessages appends msgs to topic, picking partitions by key hash like
+// the kafka.Hash balancer. Unknown topics are created with one partition.
+func (b *Broker) WriteMessages(topic string, msgs ...kafka.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = [][]kafka.Message{{}}
+	}
+	partitions := b.topics[topic]
+	ids := make([]int, len(partitions))
+	for i := range ids {
+		ids[i] = i
+	}
+	balancer := &kafka.Hash{}
+	for _, m := range msgs {
+		p := balancer.Balance(m, ids...)
+		m.Topic = topic
+		m.Partition = p
+		m.Offset = int64(len(partitions[p]))
+		m.Time = time.Now()
+		partitions[p] = append(partitions[p], m)
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+	return nil
+}
+
+// NewReader reads one partition of topic from the first offset.
+func (b *Broker) NewReader(topic string, partition int) *Reader {
+	return &Reader{broker: b, topic: topic, partition: partition}
+}
+
+// Reader has the partition reading methods of kafka.Reader.
+type Reader struct {
+	broker    *Broker
+	topic     string
+	partition int
+	mu        sync.Mutex
+	offset    int64
+}
+
+// SetOffset accepts kafka.FirstOffset and kafka.LastOffset as well as
+// absolute offsets.
+func (r *Reader) SetOffset(offset int64) error {
+	switch offset {
+	case kafka.FirstOffset:
+		offset = 0
+	case kafka.LastOffset:
+		last, err := r.broker.LastOffset(r.topic, r.partition)
+		if err != nil {
+			return err
+		}
+		offset = last
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.offset = offset
+	return nil
+}
+
+// ReadMessage blocks until the next message is written or ctx is done.
+func (r *Reader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		r.broker.mu.Lock()
+		log, err := r.broker.partition(r.topic, r.partition)
+		notify := r.broker.notify
+		r.broker.mu.Unlock()
+		if err != nil {
+			return kafka.Message{}, err
+		}
+		if r.offset < int64(len(log)) {
+			m := log[r.offset]
+			r.offset++
+			return m, nil
+		}
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// FetchMessage is ReadMessage, there are no consumer group commits.
+func (r *Reader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	return r.ReadMessage(ctx)
+}
+
+// Close ...
+func (r *Reader) Close() error {
+	return nil
+}
@@ -9,8 +9,58 @@ import (
 	"github.com/labstack/echo"
 	"github.com/rs/xid"
 	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
 )
 
+// newActivityMsg ...
+func newActivityMsg(codec *avroreg.Codec, key, host string, activity *Activity, cmds []Command) (msg kafka.Message, err error) {
+	guid := xid.New()
+	activity.Id = guid.String()
+	activity.Uts = time.Now().Unix()
+	activity.Host = host
+	activity.Redis = cmds
+	jsonB, err := json.Marshal(activity)
+	if err != nil {
+		return
+	}
+	native, _, err := codec.NativeFromTextual(jsonB)
+	if err != nil {
+		return
+	}
+	binary, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return
+	}
+	msg = kafka.Message{
+		Key:   []byte(key),
+		Value: binary,
+	}
+	return
+}
+
+// takedown produces an activity that removes the given projections.
+func takedown(cc *CustomContext, key string, cmds []Command) error {
+	activity := new(Activity)
+	if err := cc.Bind(activity); err != nil {
+		return cc.JSON(http.StatusBadRequest, ErrResponse{
+			Message: fmt.Sprintf("Bind error: %v", err),
+		})
+	}
+	host := cc.Request().Header.Get("X-Forwarded-For")
+	msg, err := newActivityMsg(cc.Codecs.Activity, key, host, activity, cmds)
+	if err != nil {
+		return cc.JSON(http.StatusInternalServerError, ErrResponse{
+			Message: fmt.Sprintf("create takedown msg error: %v", err),
+		})
+	}
+	if err := produceMsg(&cc.Config, cc.Config.Activity.Topic, cc.Config.Activity.Ack, &msg); err != nil {
+		return cc.JSON(http.StatusInternalServerError, ErrResponse{
+			Message: fmt.Sprintf("produce msg error: %v", err),
+		})
+	}
+	return cc.JSON(http.StatusOK, &SimpleResponse{Result: "success"})
+}
+
 // favComment ...
 func favComment(c echo.Context) error {
 	cc := c.(*CustomContext)
@@ -35,7 +85,9 @@ func favComment(c echo.Context) error {
 		Key:   key,
 		From:  "VALUE",
 		Value: commentid,
+		Score: cc.Config.Score.Fav,
 	})
+	a.Redis = cmds
 	jsonB, err := json.Marshal(a)
 	if err != nil {
 		return cc.JSON(http.StatusBadRequest, ErrResponse{
@@ -88,6 +140,7 @@ func subjectInc(c echo.Context) error {
 		Key:   key,
 		From:  "VALUE",
 		Value: val,
+		Score: cc.Config.Score.View,
 	})
 	activity.Id = guid.String()
 	activity.Uts = uts
@@ -136,7 +189,7 @@ func favComments(c echo.Context) error {
 			Message: fmt.Sprintf("Bind error: %v", err),
 		})
 	}
-	results, err := cc.Client.ZRangeWithScores(key, postRange.Start, postRange.Stop).Result()
+	results, err := cc.Client.ZRangeWithScores(key, postRange.Start, postRange.Stop)
 	if err != nil {
 		return cc.JSON(http.StatusInternalServerError, ErrResponse{
 			Message: fmt.Sprintf("take comment rank data error: %v", err),
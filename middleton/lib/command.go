@@ -0,0 +1,11 @@
+package lib
+
+// HDelCommand removes field from the hash at key.
+func HDelCommand(key, field string) Command {
+	return Command{Group: "HDEL", Key: key, Field: field, From: "VALUE"}
+}
+
+// ZRemCommand removes member from the sorted set at key.
+func ZRemCommand(key, member string) Command {
+	return Command{Group: "ZREM", Key: key, From: "VALUE", Value: member}
+}
@@ -10,9 +10,9 @@ import (
 	"time"
 
 	"github.com/labstack/echo"
-	"github.com/linkedin/goavro"
 	"github.com/rs/xid"
 	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
 )
 
 // CommentKey ...
@@ -38,7 +38,7 @@ func detailComments(c echo.Context) error {
 	idxs := []int64{}
 	for _, postID := range *p {
 		f := CommentDetailKey(postID.ID)
-		size, err := cc.Client.HGet(k, f).Result()
+		size, err := cc.Client.HGet(k, f)
 		if err != nil {
 			return cc.JSON(http.StatusBadRequest, ErrResponse{
 				Message: "get comment idx  error",
@@ -50,7 +50,7 @@ func detailComments(c echo.Context) error {
 	}
 	details := []interface{}{}
 	for _, idx := range idxs {
-		detail, err := cc.Client.LIndex(k, idx).Result()
+		detail, err := cc.Client.LIndex(k, idx)
 		if err != nil {
 			return cc.JSON(http.StatusBadRequest, ErrResponse{
 				Message: fmt.Sprintf("get comment detail  error: %v", err),
@@ -89,7 +89,7 @@ func rangeComment(c echo.Context) error {
 			Message: "range over limit",
 		})
 	}
-	comment, err := cc.Client.LRange(key, r.Start, r.Stop).Result()
+	comment, err := cc.Client.LRange(key, r.Start, r.Stop)
 	if err != nil {
 		return errors.New(fmt.Sprintf("range comment error: %v", err))
 	}
@@ -103,10 +103,26 @@ func rangeComment(c echo.Context) error {
 		}
 		resp = append(resp, native)
 	}
+	live, err := dropTakenDown(cc.Client, key, CommentDetailKey, &resp)
+	if err != nil {
+		return errors.New(fmt.Sprintf("filter comment error: %v", err))
+	}
 	cc.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
 	cc.Response().WriteHeader(http.StatusOK)
 
-	return json.NewEncoder(c.Response()).Encode(resp)
+	return json.NewEncoder(c.Response()).Encode(live)
+}
+
+// deleteComment ...
+func deleteComment(c echo.Context) error {
+	cc := c.(*CustomContext)
+	key := CommentKey(cc.Param("subject_id"))
+	id := cc.Param("xid")
+	cmds := []Command{
+		HDelCommand(key, CommentDetailKey(id)),
+		ZRemCommand(key, id),
+	}
+	return takedown(cc, key, cmds)
 }
 
 // newComment ...
@@ -125,18 +141,19 @@ func newComment(c echo.Context) error {
 	cmds := []Command{}
 	cmds = append(cmds, Command{
 		Group: "LISTS",
-		Key:   key,
+		Key:   CommentKey("{subjectid}"),
 		From:  "SELF",
 	}, Command{
 		Group: "HASHES",
-		Key:   key,
-		Field: CommentDetailKey(guid.String()),
+		Key:   CommentKey("{subjectid}"),
+		Field: CommentDetailKey("{id}"),
 		From:  "PREVIOUS_VALUE",
 	}, Command{
 		Group: "ZADD",
-		Key:   key,
+		Key:   CommentKey("{subjectid}"),
 		From:  "VALUE",
-		Value: guid.String(),
+		Value: "{id}",
+		Score: 1,
 	})
 	comment.Id = guid.String()
 	comment.Host = host
@@ -175,11 +192,11 @@ func newComment(c echo.Context) error {
 type commentRure struct {
 	Id     string
 	Offset int64
-	Codec  *goavro.Codec
+	Codec  *avroreg.Codec
 }
 
 // NewCommentRure ...
-func NewCommentRure(id string, codec *goavro.Codec) commentRure {
+func NewCommentRure(id string, codec *avroreg.Codec) commentRure {
 	return commentRure{Id: id, Offset: -1, Codec: codec}
 }
 
@@ -216,7 +233,7 @@ func searchComment(c echo.Context) error {
 	wg := &sync.WaitGroup{}
 	for _, commentOffset := range *o {
 		wg.Add(1)
-		go func(conf Config, codec *goavro.Codec, topic string, partition int, offset int64, id string) {
+		go func(conf Config, codec *avroreg.Codec, topic string, partition int, offset int64, id string) {
 			rule := NewCommentRure(id, codec)
 			msgs := searchKafka(conf, codec, topic, partition, offset, &rule)
 			for _, msg := range msgs {
@@ -3,13 +3,24 @@ package lib
 import "github.com/BurntSushi/toml"
 
 type Config struct {
-	Subject  MetaConfig    `toml:"subject"`
-	Activity MetaConfig    `toml:"activity"`
-	Comment  MetaConfig    `toml:"comment"`
-	Metainfo MetaConfig    `toml:"metainfo"`
-	Kafka    KafkaConfig   `toml:"kafka"`
-	Ledisdb  LedisdbConfig `toml:"ledisdb"`
-	Ogcache  OgcacheConfig `toml:"ogcache"`
+	Subject  MetaConfig     `toml:"subject"`
+	Activity MetaConfig     `toml:"activity"`
+	Comment  MetaConfig     `toml:"comment"`
+	Metainfo MetaConfig     `toml:"metainfo"`
+	Kafka    KafkaConfig    `toml:"kafka"`
+	Ledisdb  LedisdbConfig  `toml:"ledisdb"`
+	Ogcache  OgcacheConfig  `toml:"ogcache"`
+	Score    ScoreConfig    `toml:"score"`
+	Registry RegistryConfig `toml:"registry"`
+}
+
+type RegistryConfig struct {
+	URL string `toml:"url"`
+}
+
+type ScoreConfig struct {
+	Fav  float64 `toml:"fav"`
+	View float64 `toml:"view"`
 }
 
 type OgcacheConfig struct {
@@ -21,14 +32,18 @@ type OgcacheConfig struct {
 }
 
 type MetaConfig struct {
-	Limit     int    `toml:"limit"`
-	Schema    string `toml:"schema"`
-	Topic     string `toml:"topic"`
-	Partition int    `toml:"partition"`
-	Ack       int    `toml:"ack"`
+	Limit  int    `toml:"limit"`
+	Schema string `toml:"schema"`
+	// UnframedSchema is the schema of messages and projections written
+	// without a registry schema id, Schema when empty.
+	UnframedSchema string `toml:"unframed_schema"`
+	Topic          string `toml:"topic"`
+	Partition      int    `toml:"partition"`
+	Ack            int    `toml:"ack"`
 }
 
 type KafkaConfig struct {
+	Backend      string   `toml:"backend"`
 	Minbytes     int      `toml:"minbytes"`
 	Maxbytes     int      `toml:"maxbytes"`
 	Cancel       int      `toml:"cancel"`
@@ -42,6 +57,7 @@ type Broker struct {
 }
 
 type LedisdbConfig struct {
+	Backend  string `toml:"backend"`
 	Addr     string `toml:"addr"`
 	Password string `toml:"password"`
 	DB       int    `toml:"db"`
@@ -54,5 +70,11 @@ func DecodeConfigToml(tomlfile string) (Config, error) {
 	if err != nil {
 		return config, err
 	}
+	if config.Score.Fav == 0 {
+		config.Score.Fav = 1
+	}
+	if config.Score.View == 0 {
+		config.Score.View = 1
+	}
 	return config, nil
 }
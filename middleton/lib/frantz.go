@@ -8,15 +8,16 @@ import (
 	"time"
 
 	"github.com/labstack/echo"
-	"github.com/linkedin/goavro"
 	kafka "github.com/segmentio/kafka-go"
+	"github.com/yasukun/roure/memkafka"
+	avroreg "github.com/yasukun/roure/registry/lib"
 )
 
 // searchOffset ...
 func searchOffset(c echo.Context) error {
 	cc := c.(*CustomContext)
 	filter := cc.Param("filter")
-	alloffset, err := cc.Client.HGetAll("offset").Result()
+	alloffset, err := cc.Client.HGetAll("offset")
 	if err != nil {
 		cc.Logger().Errorf("redisdb hgetall error: %v", err)
 		return err
@@ -54,8 +55,21 @@ func searchOffset(c echo.Context) error {
 	return cc.JSON(http.StatusOK, filterd)
 }
 
+// memoryBroker returns the in-process broker named after the first broker
+// address.
+func memoryBroker(conf *Config) *memkafka.Broker {
+	name := ""
+	if len(conf.Kafka.Brokers) > 0 {
+		name = conf.Kafka.Brokers[0].Addr
+	}
+	return memkafka.Named(name)
+}
+
 // produceMsg ...
 func produceMsg(conf *Config, topic string, ack int, msg *kafka.Message) error {
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		return memoryBroker(conf).WriteMessages(topic, *msg)
+	}
 	addrs := []string{}
 	for _, broker := range conf.Kafka.Brokers {
 		addrs = append(addrs, broker.Addr)
@@ -79,19 +93,28 @@ func produceMsg(conf *Config, topic string, ack int, msg *kafka.Message) error {
 }
 
 // searchKafka ...
-func searchKafka(conf Config, codec *goavro.Codec, topic string, partition int, offset int64, rule Filter) []kafka.Message {
-	brokers := []string{}
-	for _, broker := range conf.Kafka.Brokers {
-		brokers = append(brokers, broker.Addr)
+func searchKafka(conf Config, codec *avroreg.Codec, topic string, partition int, offset int64, rule Filter) []kafka.Message {
+	var r interface {
+		FetchMessage(ctx context.Context) (kafka.Message, error)
+		SetOffset(offset int64) error
+		Close() error
+	}
+	if conf.Kafka.Backend == memkafka.BACKEND_MEMORY {
+		r = memoryBroker(&conf).NewReader(topic, partition)
+	} else {
+		brokers := []string{}
+		for _, broker := range conf.Kafka.Brokers {
+			brokers = append(brokers, broker.Addr)
+		}
+		r = kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   brokers,
+			Topic:     topic,
+			Partition: partition,
+			MinBytes:  conf.Kafka.Minbytes,
+			MaxBytes:  conf.Kafka.Maxbytes,
+			MaxWait:   time.Duration(conf.Kafka.MaxWait) * time.Second,
+		})
 	}
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   brokers,
-		Topic:     topic,
-		Partition: partition,
-		MinBytes:  conf.Kafka.Minbytes,
-		MaxBytes:  conf.Kafka.Maxbytes,
-		MaxWait:   time.Duration(conf.Kafka.MaxWait) * time.Second,
-	})
 	defer r.Close()
 	r.SetOffset(offset - 1)
 	msgs := []kafka.Message{}
@@ -4,32 +4,64 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/go-redis/redis"
 	"github.com/labstack/echo"
-	"github.com/linkedin/goavro"
 	ogclient "github.com/yasukun/ogcache-server/client"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
 )
 
 type Codecs struct {
-	Subject  *goavro.Codec
-	Comment  *goavro.Codec
-	Activity *goavro.Codec
-	Metainfo *goavro.Codec
+	Subject  *avroreg.Codec
+	Comment  *avroreg.Codec
+	Activity *avroreg.Codec
+	Metainfo *avroreg.Codec
 }
 
 type CustomContext struct {
 	echo.Context
 	Config
-	*redis.Client
+	Client storage.Store
 	Codecs
 }
 
 // llen ...
-func llen(client *redis.Client, key string) (i64 int64, err error) {
-	i64, err = client.LLen(key).Result()
+func llen(client storage.Store, key string) (i64 int64, err error) {
+	i64, err = client.LLen(key)
 	return
 }
 
+// dropTakenDown keeps the decoded records whose inverted index entry in key
+// still exists, checking the whole page with one HMGET. Takedowns remove the
+// index entry instead of the list item so that the positions stored for the
+// other records stay valid.
+func dropTakenDown(client storage.Store, key string, detailKey func(string) string, natives *[]interface{}) (*[]interface{}, error) {
+	records := []interface{}{}
+	fields := []string{}
+	for _, native := range *natives {
+		record, ok := native.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := record["id"].(string)
+		records = append(records, native)
+		fields = append(fields, detailKey(id))
+	}
+	live := []interface{}{}
+	if len(fields) == 0 {
+		return &live, nil
+	}
+	values, err := client.HMGet(key, fields...)
+	if err != nil {
+		return natives, err
+	}
+	for i, value := range values {
+		if value != nil {
+			live = append(live, records[i])
+		}
+	}
+	return &live, nil
+}
+
 // openGraph ...
 func openGraph(c echo.Context) error {
 	cc := c.(*CustomContext)
@@ -49,6 +81,20 @@ func openGraph(c echo.Context) error {
 	return cc.JSON(http.StatusOK, og)
 }
 
+// NewEcho sets up an echo server with the CustomContext middleware and the
+// api routes.
+func NewEcho(conf Config, client storage.Store, codecs Codecs) *echo.Echo {
+	e := echo.New()
+	e.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cc := &CustomContext{Context: c, Config: conf, Client: client, Codecs: codecs}
+			return h(cc)
+		}
+	})
+	Routes(e)
+	return e
+}
+
 // Routes ...
 func Routes(e *echo.Echo) {
 	r := e.Group("/api")
@@ -68,6 +114,7 @@ func Routes(e *echo.Echo) {
 	r.POST("/subject/new/:category", newSubject)
 	r.POST("/subject/range/:category", rangeSubject)
 	r.POST("/subject/search/:category/:xid", searchSubject)
+	r.POST("/subject/delete/:category/:xid", deleteSubject)
 
 	// kafka
 	r.GET("/offset/:filter", searchOffset)
@@ -77,6 +124,7 @@ func Routes(e *echo.Echo) {
 	r.POST("/comment/new/", newComment)
 	r.POST("/comment/range/:subject_id", rangeComment)
 	r.POST("/comment/search/:subject_id", rangeComment)
+	r.POST("/comment/delete/:subject_id/:xid", deleteComment)
 
 	// activity
 	r.POST("/activity/favarite/comment/:subject_id/:xid", favComment)
@@ -25,7 +25,7 @@ func listMetainfo(c echo.Context) error {
 			Message: fmt.Sprintf("%s mismatch type", metatype),
 		})
 	}
-	results, err := cc.Client.ZRevRange(k, 0, -1).Result()
+	results, err := cc.Client.ZRevRange(k, 0, -1)
 	if err != nil {
 		return cc.JSON(http.StatusBadRequest, ErrResponse{
 			Message: fmt.Sprintf("zrevrange error: %v", err),
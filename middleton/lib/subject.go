@@ -10,9 +10,9 @@ import (
 	"time"
 
 	"github.com/labstack/echo"
-	"github.com/linkedin/goavro"
 	"github.com/rs/xid"
 	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
 )
 
 // lenSubject ...
@@ -29,7 +29,7 @@ func lenSubject(c echo.Context) error {
 }
 
 // newSubjectMsg ...
-func newSubjectMsg(codec *goavro.Codec, category, host string, subject *Subject) (msg kafka.Message, resp PostResponse, err error) {
+func newSubjectMsg(codec *avroreg.Codec, category, host string, subject *Subject) (msg kafka.Message, resp PostResponse, err error) {
 	guid := xid.New()
 	resp = PostResponse{Type: "subject", Category: category, ID: guid.String()}
 	uts := time.Now().Unix()
@@ -40,20 +40,21 @@ func newSubjectMsg(codec *goavro.Codec, category, host string, subject *Subject)
 	cmds := []Command{}
 	cmds = append(cmds, Command{
 		Group: "LISTS",
-		Key:   SubjectKey(category),
+		Key:   SubjectKey("{category}"),
 		From:  "SELF",
 		Value: "",
 	}, Command{
 		Group: "HASHES",
-		Key:   SubjectKey(category),
-		Field: SubjectDetailKey(guid.String()),
+		Key:   SubjectKey("{category}"),
+		Field: SubjectDetailKey("{id}"),
 		From:  "PREVIOUS_VALUE",
 		Value: "",
 	}, Command{
-		Group: "ZADD",
-		Key:   SubjectKey(category),
-		From:  "VALUE",
-		Value: guid.String(),
+		Group:     "ZADD",
+		Key:       SubjectKey("{category}"),
+		From:      "VALUE",
+		Value:     "{id}",
+		ScoreFrom: "uts",
 	})
 	subject.Redis = cmds
 	if subject.Images == nil {
@@ -93,7 +94,7 @@ func SubjectDetailKey(id string) string {
 }
 
 // responseSubject ...
-func responseSubject(codec *goavro.Codec, subjects *[]string) (*[]interface{}, error) {
+func responseSubject(codec *avroreg.Codec, subjects *[]string) (*[]interface{}, error) {
 	resp := []interface{}{}
 	for _, binary := range *subjects {
 		native, _, err := codec.NativeFromBinary([]byte(binary))
@@ -130,7 +131,7 @@ func rangeSubject(c echo.Context) error {
 		})
 	}
 
-	subjects, err := cc.Client.LRange(k, r.Start, r.Stop).Result()
+	subjects, err := cc.Client.LRange(k, r.Start, r.Stop)
 	if err != nil {
 		return errors.New(fmt.Sprintf("range subject error: %v", err))
 	}
@@ -138,6 +139,10 @@ func rangeSubject(c echo.Context) error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("build subject response error: %v", err))
 	}
+	s, err = dropTakenDown(cc.Client, k, SubjectDetailKey, s)
+	if err != nil {
+		return errors.New(fmt.Sprintf("filter subject error: %v", err))
+	}
 	cc.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
 	cc.Response().WriteHeader(http.StatusOK)
 
@@ -150,7 +155,7 @@ func latestSubject(c echo.Context) error {
 	cc := c.(*CustomContext)
 	k := SubjectKey(cc.Param("category"))
 	limit := int64(cc.Config.Subject.Limit)
-	subjects, err := cc.Client.LRange(k, limit*-1, -1).Result()
+	subjects, err := cc.Client.LRange(k, limit*-1, -1)
 	if err != nil {
 		return errors.New(fmt.Sprintf("laitest subject error: %v", err))
 	}
@@ -158,6 +163,10 @@ func latestSubject(c echo.Context) error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("build subject response error: %v", err))
 	}
+	s, err = dropTakenDown(cc.Client, k, SubjectDetailKey, s)
+	if err != nil {
+		return errors.New(fmt.Sprintf("filter subject error: %v", err))
+	}
 	cc.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
 	cc.Response().WriteHeader(http.StatusOK)
 
@@ -169,13 +178,13 @@ func detailSubject(c echo.Context) error {
 	cc := c.(*CustomContext)
 	k := SubjectKey(cc.Param("category"))
 	f := SubjectDetailKey(cc.Param("xid"))
-	size, err := cc.Client.HGet(k, f).Result()
+	size, err := cc.Client.HGet(k, f)
 	if err != nil {
 		return errors.New(fmt.Sprintf("detail subject size error: %v", err))
 	}
 	i64, err := strconv.ParseInt(size, 10, 64)
 	idx := i64 - 1
-	detail, err := cc.Client.LIndex(k, idx).Result()
+	detail, err := cc.Client.LIndex(k, idx)
 	if err != nil {
 		return errors.New(fmt.Sprintf("detail subject error: %v", err))
 	}
@@ -192,7 +201,11 @@ func indexSubject(c echo.Context) error {
 	cc := c.(*CustomContext)
 	k := SubjectKey(cc.Param("category"))
 	f := SubjectDetailKey(cc.Param("xid"))
-	idx, err := cc.Client.HGet(k, f).Int64()
+	v, err := cc.Client.HGet(k, f)
+	if err != nil {
+		return err
+	}
+	idx, err := strconv.ParseInt(v, 10, 64)
 	if err != nil {
 		return err
 	}
@@ -204,11 +217,11 @@ type subjectRure struct {
 	Id       string
 	Offset   int64
 	Category string
-	Codec    *goavro.Codec
+	Codec    *avroreg.Codec
 }
 
 // NewSubjectRure ...
-func NewSubjectRure(id, category string, codec *goavro.Codec) subjectRure {
+func NewSubjectRure(id, category string, codec *avroreg.Codec) subjectRure {
 	return subjectRure{Id: id, Offset: -1, Category: category, Codec: codec}
 }
 
@@ -259,6 +272,19 @@ func newSubject(c echo.Context) error {
 	return cc.JSON(http.StatusOK, resp)
 }
 
+// deleteSubject ...
+func deleteSubject(c echo.Context) error {
+	cc := c.(*CustomContext)
+	category := cc.Param("category")
+	id := cc.Param("xid")
+	key := SubjectKey(category)
+	cmds := []Command{
+		HDelCommand(key, SubjectDetailKey(id)),
+		ZRemCommand(key, id),
+	}
+	return takedown(cc, key, cmds)
+}
+
 // searchSubject ...
 func searchSubject(c echo.Context) error {
 	cc := c.(*CustomContext)
@@ -275,7 +301,7 @@ func searchSubject(c echo.Context) error {
 	wg := &sync.WaitGroup{}
 	for _, subjectOffset := range *o {
 		wg.Add(1)
-		go func(conf Config, codec *goavro.Codec, topic string, partition int, offset int64, id, category string) {
+		go func(conf Config, codec *avroreg.Codec, topic string, partition int, offset int64, id, category string) {
 			rule := NewSubjectRure(id, category, codec)
 			msgs := searchKafka(conf, codec, topic, partition, offset, &rule)
 			for _, msg := range msgs {
@@ -8,11 +8,10 @@ import (
 	"os/signal"
 	"time"
 
-	"github.com/go-redis/redis"
-	"github.com/labstack/echo"
 	"github.com/labstack/gommon/log"
-	"github.com/linkedin/goavro"
 	"github.com/yasukun/roure/middleton/lib"
+	avroreg "github.com/yasukun/roure/registry/lib"
+	"github.com/yasukun/roure/storage"
 )
 
 // Usage ...
@@ -23,33 +22,55 @@ func Usage() {
 }
 
 // SelectCodec ...
-func SelectCodec(name string) (codec *goavro.Codec, err error) {
+func SelectCodec(client *avroreg.Client, name, unframedName string) (codec *avroreg.Codec, err error) {
 	schema, err := Asset(name)
 	if err != nil {
 		return
 	}
-	codec, err = goavro.NewCodec(string(schema))
+	var unframed []byte
+	if unframedName != "" {
+		if unframed, err = Asset(unframedName); err != nil {
+			return
+		}
+	}
+	codec, err = avroreg.NewCodec(client, string(schema), string(unframed))
+	if err != nil {
+		return
+	}
+	return
+}
+
+// SelectTopicCodec selects the codec of a topic middleton produces to and
+// registers its schema, so messages are framed with the schema id.
+func SelectTopicCodec(client *avroreg.Client, meta lib.MetaConfig) (codec *avroreg.Codec, err error) {
+	codec, err = SelectCodec(client, meta.Schema, meta.UnframedSchema)
 	if err != nil {
 		return
 	}
+	err = codec.Register(meta.Topic + "-value")
 	return
 }
 
 // loadCodecs ...
 func loadCodecs(conf lib.Config) (codecs lib.Codecs, err error) {
-	subjectCodec, err := SelectCodec(conf.Subject.Schema)
+	var client *avroreg.Client
+	if conf.Registry.URL != "" {
+		client = avroreg.NewClient(conf.Registry.URL)
+	}
+	subjectCodec, err := SelectTopicCodec(client, conf.Subject)
 	if err != nil {
 		return
 	}
-	commentCodec, err := SelectCodec(conf.Comment.Schema)
+	commentCodec, err := SelectTopicCodec(client, conf.Comment)
 	if err != nil {
 		return
 	}
-	activityCodec, err := SelectCodec(conf.Activity.Schema)
+	activityCodec, err := SelectTopicCodec(client, conf.Activity)
 	if err != nil {
 		return
 	}
-	metainfoCodec, err := SelectCodec(conf.Metainfo.Schema)
+	// metainfo comes from steve and never goes through kafka
+	metainfoCodec, err := SelectCodec(nil, conf.Metainfo.Schema, "")
 	if err != nil {
 		return
 	}
@@ -80,26 +101,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	client := redis.NewClient(&redis.Options{
+	client, err := storage.Open(storage.Options{
+		Backend:  conf.Ledisdb.Backend,
 		Addr:     conf.Ledisdb.Addr,
 		Password: conf.Ledisdb.Password,
 		DB:       conf.Ledisdb.DB,
 	})
+	if err != nil {
+		log.Printf("open storage error %v\n", err)
+		os.Exit(1)
+	}
 
 	// Setup
-	e := echo.New()
-
-	e.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			cc := &lib.CustomContext{c, conf, client, codecs}
-			return h(cc)
-		}
-	})
+	e := lib.NewEcho(conf, client, codecs)
 
 	e.Logger.SetLevel(log.INFO)
 
-	lib.Routes(e)
-
 	// Start server
 	go func() {
 		if err := e.Start(*addr); err != nil {
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CONTENT_TYPE = "application/vnd.schemaregistry.v1+json"
+
+type schemaRequest struct {
+	Schema string `json:"schema"`
+}
+
+type schemaResponse struct {
+	Schema string `json:"schema"`
+}
+
+type idResponse struct {
+	ID int `json:"id"`
+}
+
+type errResponse struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Client talks to a Confluent compatible schema registry. Schemas never
+// change once they have an id, so lookups are cached for good.
+type Client struct {
+	URL     string
+	http    *http.Client
+	mu      sync.RWMutex
+	schemas map[int]string
+}
+
+// NewClient ...
+func NewClient(baseURL string) *Client {
+	return &Client{
+		URL:     strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: 10 * time.Second},
+		schemas: map[int]string{},
+	}
+}
+
+// do ...
+func (c *Client) do(method, path string, body, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE)
+	req.Header.Set("Accept", CONTENT_TYPE)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e errResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			return fmt.Errorf("schema registry %s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("schema registry %s %s: %s (%d)", method, path, e.Message, e.ErrorCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Register registers schema under subject and returns its id. Registering
+// a schema again returns the id it already has.
+func (c *Client) Register(subject, schema string) (int, error) {
+	var resp idResponse
+	path := "/subjects/" + url.PathEscape(subject) + "/versions"
+	if err := c.do(http.MethodPost, path, schemaRequest{Schema: schema}, &resp); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.schemas[resp.ID] = schema
+	c.mu.Unlock()
+	return resp.ID, nil
+}
+
+// Schema returns the schema registered with id.
+func (c *Client) Schema(id int) (string, error) {
+	c.mu.RLock()
+	schema, ok := c.schemas[id]
+	c.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+	var resp schemaResponse
+	if err := c.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.schemas[id] = resp.Schema
+	c.mu.Unlock()
+	return resp.Schema, nil
+}
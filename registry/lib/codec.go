@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/linkedin/goavro"
+)
+
+// writerCodec decodes data written with an older schema and resolves it
+// against the reader schema.
+type writerCodec struct {
+	codec    *goavro.Codec
+	resolver *Resolver
+}
+
+// decode ...
+func (w *writerCodec) decode(buf []byte) (interface{}, []byte, error) {
+	native, rest, err := w.codec.NativeFromBinary(buf)
+	if err != nil || w.resolver == nil {
+		return native, rest, err
+	}
+	native, err = w.resolver.Resolve(native)
+	return native, rest, err
+}
+
+// Codec is a goavro codec that reads and writes the registry wire format.
+// Decoded data always has the shape of the local (reader) schema. Framed
+// messages are decoded with the writer schema looked up by id. Messages
+// without the header, such as data written before the registry was
+// introduced, carry no version and are decoded with the one configured for
+// them; data that does not fit it is an error, not a guess.
+type Codec struct {
+	*goavro.Codec
+	ID       int
+	client   *Client
+	unframed *writerCodec
+	mu       sync.RWMutex
+	writers  map[int]*writerCodec
+}
+
+// NewCodec creates a codec reading and writing schema. unframed is the
+// schema messages without the header were written with, schema itself when
+// empty.
+func NewCodec(client *Client, schema, unframed string) (*Codec, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+	c := &Codec{Codec: codec, client: client, writers: map[int]*writerCodec{}}
+	if unframed != "" && unframed != schema {
+		if c.unframed, err = newWriterCodec(unframed, schema); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// newWriterCodec ...
+func newWriterCodec(writerSchema, readerSchema string) (*writerCodec, error) {
+	codec, err := goavro.NewCodec(writerSchema)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := NewResolver(writerSchema, readerSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &writerCodec{codec: codec, resolver: resolver}, nil
+}
+
+// Register registers the local schema under subject. Messages encoded by
+// the codec are framed with the id from then on.
+func (c *Codec) Register(subject string) error {
+	if c.client == nil {
+		return nil
+	}
+	id, err := c.client.Register(subject, c.Schema())
+	if err != nil {
+		return err
+	}
+	c.ID = id
+	return nil
+}
+
+// writer returns the codec of the schema registered with id.
+func (c *Codec) writer(id int) (*writerCodec, error) {
+	if id == c.ID {
+		return &writerCodec{codec: c.Codec}, nil
+	}
+	c.mu.RLock()
+	w, ok := c.writers[id]
+	c.mu.RUnlock()
+	if ok {
+		return w, nil
+	}
+	schema, err := c.client.Schema(id)
+	if err != nil {
+		return nil, err
+	}
+	w, err = newWriterCodec(schema, c.Schema())
+	if err != nil {
+		return nil, fmt.Errorf("schema %d: %v", id, err)
+	}
+	c.mu.Lock()
+	c.writers[id] = w
+	c.mu.Unlock()
+	return w, nil
+}
+
+// NativeFromBinary ...
+func (c *Codec) NativeFromBinary(buf []byte) (interface{}, []byte, error) {
+	if c.client != nil {
+		if id, payload, ok := Unframe(buf); ok {
+			w, err := c.writer(id)
+			if err != nil {
+				return nil, buf, err
+			}
+			return w.decode(payload)
+		}
+	}
+	if c.unframed == nil {
+		return c.Codec.NativeFromBinary(buf)
+	}
+	native, rest, err := c.unframed.decode(buf)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("%d trailing bytes after decoding with the unframed schema", len(rest))
+	}
+	return native, rest, err
+}
+
+// BinaryFromNative ...
+func (c *Codec) BinaryFromNative(buf []byte, native interface{}) ([]byte, error) {
+	if c.ID == 0 {
+		return c.Codec.BinaryFromNative(buf, native)
+	}
+	return c.Codec.BinaryFromNative(append(buf, Frame(c.ID, nil)...), native)
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+const testSchema = `{"type": "record", "name": "t", "fields": [{"name": "id", "type": "string"}]}`
+
+// TestCodecRoundTrip ...
+func TestCodecRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(filepath.Join(dir, "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	Routes(e, store)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	producer, err := NewCodec(NewClient(server.URL), testSchema, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Register("topic-value"); err != nil {
+		t.Fatal(err)
+	}
+	if producer.ID != 1 {
+		t.Fatalf("id %d, want 1", producer.ID)
+	}
+	framed, err := producer.BinaryFromNative(nil, map[string]interface{}{"id": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, ok := Unframe(framed); !ok || id != 1 {
+		t.Fatalf("message not framed with id 1: %v", framed)
+	}
+
+	// a consumer that never registered resolves the writer schema by id
+	consumer, err := NewCodec(NewClient(server.URL), testSchema, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := consumer.BinaryFromNative(nil, map[string]interface{}{"id": "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for buf, want := range map[string]string{string(framed): "x", string(plain): "y"} {
+		native, _, err := consumer.NativeFromBinary([]byte(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := native.(map[string]interface{})["id"]; got != want {
+			t.Fatalf("decoded %v, want %s", got, want)
+		}
+	}
+
+	reopened, err := OpenStore(filepath.Join(dir, "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Schema(1); !ok {
+		t.Fatal("schema not persisted")
+	}
+}
+
+const (
+	writerSchema = `{"type": "record", "name": "t", "namespace": "roure.avro", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "n", "type": "int"},
+		{"name": "old_name", "type": "string"},
+		{"name": "dropped", "type": "string"},
+		{"name": "items", "type": {"type": "array", "items": {"type": "record", "name": "item", "fields": [
+			{"name": "group", "type": {"type": "enum", "name": "command", "symbols": ["LISTS"]}}
+		]}}}
+	]}`
+	readerSchema = `{"type": "record", "name": "t", "namespace": "roure.avro", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "n", "type": "long"},
+		{"name": "new_name", "type": "string", "aliases": ["old_name"]},
+		{"name": "opt", "type": ["null", "string"], "default": null},
+		{"name": "items", "type": {"type": "array", "items": {"type": "record", "name": "item", "fields": [
+			{"name": "group", "type": {"type": "enum", "name": "command", "symbols": ["LISTS", "DEL"]}},
+			{"name": "score", "type": "double", "default": 1}
+		]}}}
+	]}`
+)
+
+// TestCodecPrevious ...
+func TestCodecPrevious(t *testing.T) {
+	writer, err := NewCodec(nil, writerSchema, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := writer.BinaryFromNative(nil, map[string]interface{}{
+		"id": "x", "n": int32(3), "old_name": "renamed", "dropped": "gone",
+		"items": []interface{}{map[string]interface{}{"group": "LISTS"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewCodec(nil, readerSchema, writerSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, _, err := reader.NativeFromBinary(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := native.(map[string]interface{})
+	if record["n"] != int64(3) || record["new_name"] != "renamed" || record["opt"] != nil {
+		t.Fatalf("unexpected record %v", record)
+	}
+	if _, ok := record["dropped"]; ok {
+		t.Fatal("dropped field kept")
+	}
+	item := record["items"].([]interface{})[0].(map[string]interface{})
+	if item["group"] != "LISTS" || item["score"] != float64(1) {
+		t.Fatalf("unexpected item %v", item)
+	}
+	// the resolved record encodes with the reader schema
+	if _, err := reader.BinaryFromNative(nil, native); err != nil {
+		t.Fatal(err)
+	}
+}
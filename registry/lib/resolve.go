@@ -0,0 +1,473 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// schemaNames indexes the named types of a parsed schema by full name.
+type schemaNames map[string]map[string]interface{}
+
+// fullName ...
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// collect records every named type below node, following the namespace
+// rules of the Avro specification.
+func (n schemaNames) collect(node interface{}, namespace string) {
+	switch t := node.(type) {
+	case []interface{}:
+		for _, branch := range t {
+			n.collect(branch, namespace)
+		}
+	case map[string]interface{}:
+		if name, ok := t["name"].(string); ok {
+			if ns, ok := t["namespace"].(string); ok {
+				namespace = ns
+			}
+			full := fullName(name, namespace)
+			if i := strings.LastIndex(full, "."); i >= 0 {
+				namespace = full[:i]
+			}
+			t["fullname"] = full
+			t["namespace"] = namespace
+			n[full] = t
+		}
+		switch t["type"] {
+		case "record", "error":
+			fields, _ := t["fields"].([]interface{})
+			for _, f := range fields {
+				if field, ok := f.(map[string]interface{}); ok {
+					n.collect(field["type"], namespace)
+				}
+			}
+		case "array":
+			n.collect(t["items"], namespace)
+		case "map":
+			n.collect(t["values"], namespace)
+		default:
+			if _, ok := t["type"].(string); !ok {
+				n.collect(t["type"], namespace)
+			}
+		}
+	}
+}
+
+// parseSchema ...
+func parseSchema(schema string) (interface{}, schemaNames, error) {
+	var node interface{}
+	if err := json.Unmarshal([]byte(schema), &node); err != nil {
+		return nil, nil, err
+	}
+	names := schemaNames{}
+	names.collect(node, "")
+	return node, names, nil
+}
+
+var primitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// deref turns node into a union, a primitive name or a complex type
+// definition. Named references are looked up by full name, then by the
+// name relative to namespace.
+func (n schemaNames) deref(node interface{}, namespace string) interface{} {
+	switch t := node.(type) {
+	case string:
+		if primitives[t] {
+			return t
+		}
+		if def, ok := n[fullName(t, namespace)]; ok {
+			return def
+		}
+		if def, ok := n[t]; ok {
+			return def
+		}
+		return t
+	case map[string]interface{}:
+		if typ, ok := t["type"].(string); ok && primitives[typ] {
+			return typ
+		}
+		if _, ok := t["type"].(string); !ok {
+			return n.deref(t["type"], namespace)
+		}
+	}
+	return node
+}
+
+// typeName is the name goavro uses for a union branch of type node.
+func typeName(node interface{}) string {
+	switch t := node.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		if full, ok := t["fullname"].(string); ok {
+			return full
+		}
+		if typ, ok := t["type"].(string); ok {
+			return typ
+		}
+	case []interface{}:
+		return "union"
+	}
+	return ""
+}
+
+// kind is the Avro type of node, e.g. record for every record.
+func kind(node interface{}) string {
+	switch t := node.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		typ, _ := t["type"].(string)
+		return typ
+	case []interface{}:
+		return "union"
+	}
+	return ""
+}
+
+// namespaceOf ...
+func namespaceOf(node interface{}, namespace string) string {
+	if t, ok := node.(map[string]interface{}); ok {
+		if ns, ok := t["namespace"].(string); ok {
+			return ns
+		}
+	}
+	return namespace
+}
+
+// Resolver converts data decoded with a writer schema into the shape of a
+// reader schema: fields the writer lacks get their defaults, fields the
+// reader dropped go away, renamed fields are found through the reader's
+// aliases and numbers are promoted.
+type Resolver struct {
+	writer, reader           interface{}
+	writerNames, readerNames schemaNames
+}
+
+// NewResolver ...
+func NewResolver(writerSchema, readerSchema string) (*Resolver, error) {
+	writer, writerNames, err := parseSchema(writerSchema)
+	if err != nil {
+		return nil, fmt.Errorf("writer schema: %v", err)
+	}
+	reader, readerNames, err := parseSchema(readerSchema)
+	if err != nil {
+		return nil, fmt.Errorf("reader schema: %v", err)
+	}
+	return &Resolver{writer: writer, reader: reader, writerNames: writerNames, readerNames: readerNames}, nil
+}
+
+// Resolve ...
+func (r *Resolver) Resolve(native interface{}) (interface{}, error) {
+	return r.resolve(r.writer, r.reader, "", "", native)
+}
+
+// matches reports whether data of writer type w can be read as reader
+// type rd, possibly through a promotion.
+func matches(w, rd interface{}) bool {
+	wk, rk := kind(w), kind(rd)
+	switch wk {
+	case "record", "enum", "fixed":
+		if wk != rk {
+			return false
+		}
+		wn, rn := typeName(w), typeName(rd)
+		return wn == rn || wn[strings.LastIndex(wn, ".")+1:] == rn[strings.LastIndex(rn, ".")+1:] || hasAlias(rd, wn)
+	}
+	if wk == rk {
+		return true
+	}
+	switch wk {
+	case "int":
+		return rk == "long" || rk == "float" || rk == "double"
+	case "long":
+		return rk == "float" || rk == "double"
+	case "float":
+		return rk == "double"
+	case "string":
+		return rk == "bytes"
+	case "bytes":
+		return rk == "string"
+	}
+	return false
+}
+
+// hasAlias ...
+func hasAlias(node interface{}, name string) bool {
+	t, ok := node.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	aliases, _ := t["aliases"].([]interface{})
+	for _, alias := range aliases {
+		if a, ok := alias.(string); ok && (a == name || a == name[strings.LastIndex(name, ".")+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// promote ...
+func promote(v interface{}, to string) (interface{}, error) {
+	switch n := v.(type) {
+	case int32:
+		switch to {
+		case "int":
+			return n, nil
+		case "long":
+			return int64(n), nil
+		case "float":
+			return float32(n), nil
+		case "double":
+			return float64(n), nil
+		}
+	case int64:
+		switch to {
+		case "long":
+			return n, nil
+		case "float":
+			return float32(n), nil
+		case "double":
+			return float64(n), nil
+		}
+	case float32:
+		switch to {
+		case "float":
+			return n, nil
+		case "double":
+			return float64(n), nil
+		}
+	case string:
+		if to == "bytes" {
+			return []byte(n), nil
+		}
+		return n, nil
+	case []byte:
+		if to == "string" {
+			return string(n), nil
+		}
+		return n, nil
+	}
+	return v, nil
+}
+
+// resolve ...
+func (r *Resolver) resolve(w, rd interface{}, wns, rns string, v interface{}) (interface{}, error) {
+	w, rd = r.writerNames.deref(w, wns), r.readerNames.deref(rd, rns)
+	wns, rns = namespaceOf(w, wns), namespaceOf(rd, rns)
+
+	if branches, ok := w.([]interface{}); ok {
+		if v == nil {
+			return r.resolve("null", rd, wns, rns, nil)
+		}
+		wrapped, ok := v.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return nil, fmt.Errorf("union value %v", v)
+		}
+		for key, inner := range wrapped {
+			for _, branch := range branches {
+				b := r.writerNames.deref(branch, wns)
+				if typeName(b) == key {
+					return r.resolve(b, rd, wns, rns, inner)
+				}
+			}
+			return nil, fmt.Errorf("union branch %s not in writer schema", key)
+		}
+	}
+	if branches, ok := rd.([]interface{}); ok {
+		for _, branch := range branches {
+			b := r.readerNames.deref(branch, rns)
+			if !matches(w, b) {
+				continue
+			}
+			resolved, err := r.resolve(w, b, wns, rns, v)
+			if err != nil || kind(b) == "null" {
+				return nil, err
+			}
+			return map[string]interface{}{typeName(b): resolved}, nil
+		}
+		return nil, fmt.Errorf("%s does not match any branch of the reader union", typeName(w))
+	}
+	if !matches(w, rd) {
+		return nil, fmt.Errorf("%s cannot be read as %s", typeName(w), typeName(rd))
+	}
+
+	switch kind(rd) {
+	case "record", "error":
+		return r.resolveRecord(w.(map[string]interface{}), rd.(map[string]interface{}), wns, rns, v)
+	case "enum":
+		symbol, _ := v.(string)
+		symbols, _ := rd.(map[string]interface{})["symbols"].([]interface{})
+		for _, s := range symbols {
+			if s == symbol {
+				return symbol, nil
+			}
+		}
+		if def, ok := rd.(map[string]interface{})["default"].(string); ok {
+			return def, nil
+		}
+		return nil, fmt.Errorf("enum %s has no symbol %s", typeName(rd), symbol)
+	case "array":
+		items, _ := v.([]interface{})
+		out := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			resolved, err := r.resolve(w.(map[string]interface{})["items"], rd.(map[string]interface{})["items"], wns, rns, item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, resolved)
+		}
+		return out, nil
+	case "map":
+		values, _ := v.(map[string]interface{})
+		out := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			resolved, err := r.resolve(w.(map[string]interface{})["values"], rd.(map[string]interface{})["values"], wns, rns, value)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = resolved
+		}
+		return out, nil
+	}
+	return promote(v, kind(rd))
+}
+
+// resolveRecord ...
+func (r *Resolver) resolveRecord(w, rd map[string]interface{}, wns, rns string, v interface{}) (interface{}, error) {
+	record, _ := v.(map[string]interface{})
+	writerFields := map[string]map[string]interface{}{}
+	fields, _ := w["fields"].([]interface{})
+	for _, f := range fields {
+		field := f.(map[string]interface{})
+		writerFields[field["name"].(string)] = field
+	}
+
+	out := map[string]interface{}{}
+	fields, _ = rd["fields"].([]interface{})
+	for _, f := range fields {
+		field := f.(map[string]interface{})
+		name := field["name"].(string)
+		wf, ok := writerFields[name]
+		if !ok {
+			aliases, _ := field["aliases"].([]interface{})
+			for _, alias := range aliases {
+				if a, _ := alias.(string); writerFields[a] != nil {
+					wf, ok = writerFields[a], true
+					break
+				}
+			}
+		}
+		if ok {
+			resolved, err := r.resolve(wf["type"], field["type"], wns, rns, record[wf["name"].(string)])
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", typeName(rd), name, err)
+			}
+			out[name] = resolved
+			continue
+		}
+		def, ok := field["default"]
+		if !ok {
+			return nil, fmt.Errorf("%s.%s: missing in writer schema and has no default", typeName(rd), name)
+		}
+		resolved, err := r.defaultNative(field["type"], rns, def)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s default: %v", typeName(rd), name, err)
+		}
+		out[name] = resolved
+	}
+	return out, nil
+}
+
+// defaultNative converts the JSON default of a reader field into the
+// value goavro would have decoded.
+func (r *Resolver) defaultNative(node interface{}, namespace string, def interface{}) (interface{}, error) {
+	node = r.readerNames.deref(node, namespace)
+	namespace = namespaceOf(node, namespace)
+	if branches, ok := node.([]interface{}); ok {
+		if len(branches) == 0 {
+			return nil, fmt.Errorf("empty union")
+		}
+		first := r.readerNames.deref(branches[0], namespace)
+		if kind(first) == "null" {
+			return nil, nil
+		}
+		v, err := r.defaultNative(first, namespace, def)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{typeName(first): v}, nil
+	}
+	switch kind(node) {
+	case "null":
+		return nil, nil
+	case "boolean", "string", "enum":
+		return def, nil
+	case "int":
+		n, _ := def.(float64)
+		return int32(n), nil
+	case "long":
+		n, _ := def.(float64)
+		return int64(n), nil
+	case "float":
+		n, _ := def.(float64)
+		return float32(n), nil
+	case "double":
+		n, _ := def.(float64)
+		return n, nil
+	case "bytes", "fixed":
+		s, _ := def.(string)
+		return []byte(s), nil
+	case "array":
+		items, _ := def.([]interface{})
+		out := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			v, err := r.defaultNative(node.(map[string]interface{})["items"], namespace, item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case "map":
+		values, _ := def.(map[string]interface{})
+		out := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			v, err := r.defaultNative(node.(map[string]interface{})["values"], namespace, value)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = v
+		}
+		return out, nil
+	case "record", "error":
+		values, _ := def.(map[string]interface{})
+		out := map[string]interface{}{}
+		fields, _ := node.(map[string]interface{})["fields"].([]interface{})
+		for _, f := range fields {
+			field := f.(map[string]interface{})
+			name := field["name"].(string)
+			value, ok := values[name]
+			if !ok {
+				if value, ok = field["default"]; !ok {
+					return nil, fmt.Errorf("record default misses %s", name)
+				}
+			}
+			v, err := r.defaultNative(field["type"], namespace, value)
+			if err != nil {
+				return nil, err
+			}
+			out[name] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown type %v", node)
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	ERR_SUBJECT_NOT_FOUND = 40401
+	ERR_VERSION_NOT_FOUND = 40402
+	ERR_SCHEMA_NOT_FOUND  = 40403
+	ERR_INVALID_SCHEMA    = 42201
+)
+
+type versionResponse struct {
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	ID      int    `json:"id"`
+	Schema  string `json:"schema"`
+}
+
+// errJSON ...
+func errJSON(c echo.Context, status, code int, message string) error {
+	return c.JSON(status, errResponse{ErrorCode: code, Message: message})
+}
+
+// Routes serves the part of the Confluent schema registry API the
+// services use.
+func Routes(e *echo.Echo, store *Store) {
+	e.POST("/subjects/:subject/versions", func(c echo.Context) error {
+		var req schemaRequest
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return errJSON(c, http.StatusUnprocessableEntity, ERR_INVALID_SCHEMA, err.Error())
+		}
+		id, err := store.Register(c.Param("subject"), req.Schema)
+		if err != nil {
+			return errJSON(c, http.StatusUnprocessableEntity, ERR_INVALID_SCHEMA, err.Error())
+		}
+		return c.JSON(http.StatusOK, idResponse{ID: id})
+	})
+	e.GET("/schemas/ids/:id", func(c echo.Context) error {
+		id, _ := strconv.Atoi(c.Param("id"))
+		schema, ok := store.Schema(id)
+		if !ok {
+			return errJSON(c, http.StatusNotFound, ERR_SCHEMA_NOT_FOUND, "Schema not found")
+		}
+		return c.JSON(http.StatusOK, schemaResponse{Schema: schema})
+	})
+	e.GET("/subjects", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, store.Subjects())
+	})
+	e.GET("/subjects/:subject/versions", func(c echo.Context) error {
+		ids, ok := store.Versions(c.Param("subject"))
+		if !ok {
+			return errJSON(c, http.StatusNotFound, ERR_SUBJECT_NOT_FOUND, "Subject not found")
+		}
+		versions := []int{}
+		for i := range ids {
+			versions = append(versions, i+1)
+		}
+		return c.JSON(http.StatusOK, versions)
+	})
+	e.GET("/subjects/:subject/versions/:version", func(c echo.Context) error {
+		subject := c.Param("subject")
+		ids, ok := store.Versions(subject)
+		if !ok {
+			return errJSON(c, http.StatusNotFound, ERR_SUBJECT_NOT_FOUND, "Subject not found")
+		}
+		version := len(ids)
+		if v := c.Param("version"); v != "latest" {
+			version, _ = strconv.Atoi(v)
+		}
+		if version < 1 || version > len(ids) {
+			return errJSON(c, http.StatusNotFound, ERR_VERSION_NOT_FOUND, "Version not found")
+		}
+		schema, _ := store.Schema(ids[version-1])
+		return c.JSON(http.StatusOK, versionResponse{Subject: subject, Version: version, ID: ids[version-1], Schema: schema})
+	})
+}
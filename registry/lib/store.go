@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/linkedin/goavro"
+)
+
+type storeData struct {
+	// Schemas holds schema id n at index n-1.
+	Schemas  []string         `json:"schemas"`
+	Subjects map[string][]int `json:"subjects"`
+}
+
+// Store keeps registered schemas in a JSON file.
+type Store struct {
+	path string
+	mu   sync.RWMutex
+	data storeData
+}
+
+// OpenStore loads the store at path, starting empty if it does not exist.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, data: storeData{Subjects: map[string][]int{}}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.data); err != nil {
+		return nil, err
+	}
+	if s.data.Subjects == nil {
+		s.data.Subjects = map[string][]int{}
+	}
+	return s, nil
+}
+
+// save writes the store through a temporary file so a crash never leaves
+// it half written.
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Register adds schema as the next version of subject and returns its id.
+// A schema already known keeps its id and is not added twice.
+func (s *Store) Register(subject, schema string) (int, error) {
+	if _, err := goavro.NewCodec(schema); err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(schema)); err == nil {
+		schema = buf.String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := 0
+	for i, known := range s.data.Schemas {
+		if known == schema {
+			id = i + 1
+			break
+		}
+	}
+	if id == 0 {
+		s.data.Schemas = append(s.data.Schemas, schema)
+		id = len(s.data.Schemas)
+	}
+	for _, known := range s.data.Subjects[subject] {
+		if known == id {
+			return id, nil
+		}
+	}
+	s.data.Subjects[subject] = append(s.data.Subjects[subject], id)
+	return id, s.save()
+}
+
+// Schema ...
+func (s *Store) Schema(id int) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id < 1 || id > len(s.data.Schemas) {
+		return "", false
+	}
+	return s.data.Schemas[id-1], true
+}
+
+// Subjects ...
+func (s *Store) Subjects() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subjects := []string{}
+	for subject := range s.data.Subjects {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// Versions returns the schema ids of subject, version n at index n-1.
+func (s *Store) Versions(subject string) ([]int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids, ok := s.data.Subjects[subject]
+	return append([]int{}, ids...), ok
+}
@@ -0,0 +1,26 @@
+package lib
+
+import "encoding/binary"
+
+// MAGIC_BYTE starts every message framed in the schema registry wire
+// format, followed by the schema id as a big endian uint32.
+const MAGIC_BYTE = 0
+
+const headerSize = 5
+
+// Frame prepends the wire format header for schema id to payload.
+func Frame(id int, payload []byte) []byte {
+	buf := make([]byte, headerSize, headerSize+len(payload))
+	buf[0] = MAGIC_BYTE
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	return append(buf, payload...)
+}
+
+// Unframe splits a framed message into its schema id and payload. ok is
+// false when buf does not carry the header.
+func Unframe(buf []byte) (id int, payload []byte, ok bool) {
+	if len(buf) < headerSize || buf[0] != MAGIC_BYTE {
+		return 0, buf, false
+	}
+	return int(binary.BigEndian.Uint32(buf[1:headerSize])), buf[headerSize:], true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/yasukun/roure/registry/lib"
+)
+
+// Usage ...
+func Usage() {
+	fmt.Fprint(os.Stderr, "Usage of ", os.Args[0], ":\n")
+	flag.PrintDefaults()
+	fmt.Fprint(os.Stderr, "\n")
+}
+
+func main() {
+	flag.Usage = Usage
+	addr := flag.String("addr", ":8081", "listen to server address")
+	data := flag.String("data", "registry.json", "path to schema store")
+	flag.Parse()
+
+	store, err := lib.OpenStore(*data)
+	if err != nil {
+		log.Printf("open schema store error %v\n", err)
+		os.Exit(1)
+	}
+
+	e := echo.New()
+	e.Logger.SetLevel(log.INFO)
+	lib.Routes(e, store)
+
+	go func() {
+		if err := e.Start(*addr); err != nil {
+			e.Logger.Info("shutting down the server")
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Fatal(err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/go-redis/redis"
 	"github.com/rs/xid"
 	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
 	goavro "gopkg.in/linkedin/goavro.v2"
 )
 
@@ -32,14 +33,14 @@ func NewSubject() Subject {
 	cmds := []Command{}
 	cmds = append(cmds, Command{
 		Group: "LISTS",
-		Key:   "sumbject:new",
+		Key:   "subject:{category}",
 		From:  "SELF",
 		Value: "test value",
 	})
 	cmds = append(cmds, Command{
 		Group: "HASHES",
-		Key:   "subject:new",
-		Field: "invert_idx:" + guid.String(),
+		Key:   "subject:{category}",
+		Field: "Inverted:{id}",
 		From:  "PREVINT",
 		Value: "1",
 	})
@@ -159,28 +160,28 @@ func Usage() {
 func NewTestSubjectData(category string, target int) Subject {
 	guid := xid.New()
 	uts := time.Now().Unix()
-	keyFormat := "subject:%s"
 
 	msgs := []string{"Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua.", "Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat.", "Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur. Excepteur sint occaecat cupidatat non proident, sunt in culpa qui officia deserunt mollit anim id est laborum."}
 	cmds := []Command{}
 	cmds = append(cmds, Command{
 		Group: "LISTS",
-		Key:   fmt.Sprintf(keyFormat, category),
+		Key:   "subject:{category}",
 		From:  "SELF",
 		Value: "test value",
 	})
 	cmds = append(cmds, Command{
 		Group: "HASHES",
-		Key:   fmt.Sprintf(keyFormat, category),
-		Field: "Inverted:" + guid.String(),
+		Key:   "subject:{category}",
+		Field: "Inverted:{id}",
 		From:  "PREVIOUS_VALUE",
 		Value: "",
 	})
 	cmds = append(cmds, Command{
-		Group: "ZADD",
-		Key:   fmt.Sprintf(keyFormat, category),
-		From:  "VALUE",
-		Value: guid.String(),
+		Group:     "ZADD",
+		Key:       "subject:{category}",
+		From:      "VALUE",
+		Value:     "{id}",
+		ScoreFrom: "uts",
 	})
 	tags := []Tag{}
 	tags = append(tags, Tag{Name: "zatsudan"})
@@ -209,7 +210,7 @@ func NewTestSubjectData(category string, target int) Subject {
 }
 
 // WriteSubject ...
-func WriteSubject(addr string, size int) error {
+func WriteSubject(addr, registry string, size int) error {
 	schema, err := Asset("roure.avro/subject.avsc")
 	if err != nil {
 		return err
@@ -218,6 +219,13 @@ func WriteSubject(addr string, size int) error {
 	if err != nil {
 		return err
 	}
+	schemaID := 0
+	if registry != "" {
+		schemaID, err = avroreg.NewClient(registry).Register("roure.avro.subject-value", string(schema))
+		if err != nil {
+			return err
+		}
+	}
 	w := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:      []string{addr},
 		Topic:        "roure.avro.subject",
@@ -245,6 +253,9 @@ func WriteSubject(addr string, size int) error {
 		if err != nil {
 			return err
 		}
+		if schemaID > 0 {
+			binary = avroreg.Frame(schemaID, binary)
+		}
 		msgs = append(msgs, kafka.Message{
 			Key:   []byte(categorys[r]),
 			Value: binary,
@@ -262,6 +273,7 @@ func main() {
 	kafka := flag.String("kafka", "localhost:9092", "kafka addr")
 	ledis := flag.String("ledis", "localhost:6380", "ledisdb addr")
 	datasize := flag.Int("size", 100, "size of test data")
+	registry := flag.String("registry", "", "schema registry url, frames messages when set")
 	flag.Parse()
 
 	client := redis.NewClient(&redis.Options{
@@ -278,7 +290,7 @@ func main() {
 
 	if *subject {
 		log.Println("write test data")
-		if err := WriteSubject(*kafka, *datasize); err != nil {
+		if err := WriteSubject(*kafka, *registry, *datasize); err != nil {
 			log.Fatalln(err)
 		}
 		os.Exit(0)
@@ -1,11 +1,15 @@
 package main
 
 type Command struct {
-	Group string `json:"group"`
-	Key   string `json:"key"`
-	Field string `json:"field"`
-	From  string `json:"from"`
-	Value string `json:"value"`
+	Group     string  `json:"group"`
+	Key       string  `json:"key"`
+	Field     string  `json:"field"`
+	From      string  `json:"from"`
+	Value     string  `json:"value"`
+	TTL       int64   `json:"ttl"`
+	Score     float64 `json:"score"`
+	ScoreFrom string  `json:"score_from"`
+	As        string  `json:"as"`
 }
 
 type Tag struct {
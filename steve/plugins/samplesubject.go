@@ -9,14 +9,19 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/linkedin/goavro"
 	"github.com/rs/xid"
 	kafka "github.com/segmentio/kafka-go"
+	avroreg "github.com/yasukun/roure/registry/lib"
 )
 
 type Config struct {
 	SampleSubject SampleSubjectConfig `toml:"samplesubject"`
 	Kafka         KafkaConfig         `toml:"kafka"`
+	Registry      RegistryConfig      `toml:"registry"`
+}
+
+type RegistryConfig struct {
+	URL string `toml:"url"`
 }
 
 type KafkaConfig struct {
@@ -36,11 +41,15 @@ type SampleSubjectConfig struct {
 }
 
 type Command struct {
-	Group string `json:"group"`
-	Key   string `json:"key"`
-	Field string `json:"field"`
-	From  string `json:"from"`
-	Value string `json:"value"`
+	Group     string  `json:"group"`
+	Key       string  `json:"key"`
+	Field     string  `json:"field"`
+	From      string  `json:"from"`
+	Value     string  `json:"value"`
+	TTL       int64   `json:"ttl"`
+	Score     float64 `json:"score"`
+	ScoreFrom string  `json:"score_from"`
+	As        string  `json:"as"`
 }
 
 type Tag struct {
@@ -76,7 +85,7 @@ type Subject struct {
 }
 
 var config Config
-var codec *goavro.Codec
+var codec *avroreg.Codec
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
@@ -95,11 +104,19 @@ func Init(configpath string) (err error) {
 		log.Printf("[sample subject] load asset error: %v\n", err)
 		return err
 	}
-	codec, err = goavro.NewCodec(string(schema))
+	var client *avroreg.Client
+	if config.Registry.URL != "" {
+		client = avroreg.NewClient(config.Registry.URL)
+	}
+	codec, err = avroreg.NewCodec(client, string(schema), "")
 	if err != nil {
 		log.Printf("[sample subject] create codec error: %v\n", err)
 		return err
 	}
+	if err = codec.Register(config.Kafka.Topic + "-value"); err != nil {
+		log.Printf("[sample subject] register schema error: %v\n", err)
+		return err
+	}
 	return
 }
 
@@ -110,14 +127,14 @@ func createSubject() (subject Subject) {
 	cmds := []Command{}
 	cmds = append(cmds, Command{
 		Group: "LISTS",
-		Key:   "sumbject:new",
+		Key:   "subject:{category}",
 		From:  "SELF",
 		Value: "test value",
 	})
 	cmds = append(cmds, Command{
 		Group: "HASHES",
-		Key:   "subject:new",
-		Field: "invert_idx:" + guid.String(),
+		Key:   "subject:{category}",
+		Field: "Inverted:{id}",
 		From:  "PREVIOUS_VALUE",
 		Value: "1",
 	})
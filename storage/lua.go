@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// toLua converts a command reply the way Redis hands it to scripts.
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch r := v.(type) {
+	case int64:
+		return lua.LNumber(r)
+	case string:
+		return lua.LString(r)
+	case status:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(r))
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range r {
+			t.Append(toLua(L, item))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+// fromLua converts a script result the way Redis returns it.
+func fromLua(v lua.LValue) (interface{}, error) {
+	switch r := v.(type) {
+	case lua.LNumber:
+		return int64(r), nil
+	case lua.LString:
+		return string(r), nil
+	case lua.LBool:
+		if r {
+			return int64(1), nil
+		}
+		return nil, nil
+	case *lua.LTable:
+		if e, ok := r.RawGetString("err").(lua.LString); ok {
+			return nil, errors.New(string(e))
+		}
+		if s, ok := r.RawGetString("ok").(lua.LString); ok {
+			return status(s), nil
+		}
+		out := []interface{}{}
+		for i := 1; i <= r.Len(); i++ {
+			item, err := fromLua(r.RawGetInt(i))
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				break
+			}
+			out = append(out, item)
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// Compile checks src the way SCRIPT LOAD does, without loading it.
+func Compile(src string) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	if _, err := L.LoadString(src); err != nil {
+		return errors.New("ERR Error compiling script " + err.Error())
+	}
+	return nil
+}
+
+// eval runs src with the KEYS and ARGV tables of Redis EVAL. The caller
+// holds mu.
+func (s *memServer) eval(selected *int, src string, keys, args []string) (interface{}, error) {
+	L := lua.NewState()
+	defer L.Close()
+	current := *selected
+
+	strs := func(values []string) *lua.LTable {
+		t := L.NewTable()
+		for _, v := range values {
+			t.Append(lua.LString(v))
+		}
+		return t
+	}
+	L.SetGlobal("KEYS", strs(keys))
+	L.SetGlobal("ARGV", strs(args))
+
+	call := func(raise bool) lua.LGFunction {
+		return func(L *lua.LState) int {
+			argv := []string{}
+			for i := 1; i <= L.GetTop(); i++ {
+				switch v := L.Get(i).(type) {
+				case lua.LNumber:
+					argv = append(argv, strconv.FormatFloat(float64(v), 'f', -1, 64))
+				case lua.LString:
+					argv = append(argv, string(v))
+				default:
+					L.RaiseError("Lua redis() command arguments must be strings or integers")
+					return 0
+				}
+			}
+			reply, err := s.exec(&current, argv)
+			if err != nil {
+				if raise {
+					L.RaiseError("%s", err.Error())
+					return 0
+				}
+				t := L.NewTable()
+				t.RawSetString("err", lua.LString(err.Error()))
+				L.Push(t)
+				return 1
+			}
+			L.Push(toLua(L, reply))
+			return 1
+		}
+	}
+	reply := func(field string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			t := L.NewTable()
+			t.RawSetString(field, lua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		}
+	}
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":         call(true),
+		"pcall":        call(false),
+		"error_reply":  reply("err"),
+		"status_reply": reply("ok"),
+	})
+	L.SetGlobal("redis", redis)
+
+	fn, err := L.LoadString(src)
+	if err != nil {
+		return nil, errors.New("ERR Error compiling script " + err.Error())
+	}
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, errors.New("ERR Error running script " + err.Error())
+	}
+	return fromLua(L.Get(-1))
+}
@@ -0,0 +1,949 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// status is a simple string reply such as OK.
+type status string
+
+// memDB is one database of a memory server. Like LedisDB every data type
+// has a keyspace of its own, so one key may name a list and a hash at once.
+type memDB struct {
+	kv      map[string]string
+	lists   map[string][]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+}
+
+// newMemDB ...
+func newMemDB() *memDB {
+	return &memDB{
+		kv:      map[string]string{},
+		lists:   map[string][]string{},
+		hashes:  map[string]map[string]string{},
+		zsets:   map[string]map[string]float64{},
+		sets:    map[string]map[string]bool{},
+		expires: map[string]time.Time{},
+	}
+}
+
+const (
+	typeKV   = "kv"
+	typeList = "list"
+	typeHash = "hash"
+	typeZSet = "zset"
+	typeSet  = "set"
+)
+
+// remove ...
+func (db *memDB) remove(typ, key string) bool {
+	var ok bool
+	switch typ {
+	case typeKV:
+		_, ok = db.kv[key]
+		delete(db.kv, key)
+	case typeList:
+		_, ok = db.lists[key]
+		delete(db.lists, key)
+	case typeHash:
+		_, ok = db.hashes[key]
+		delete(db.hashes, key)
+	case typeZSet:
+		_, ok = db.zsets[key]
+		delete(db.zsets, key)
+	case typeSet:
+		_, ok = db.sets[key]
+		delete(db.sets, key)
+	}
+	delete(db.expires, typ+":"+key)
+	return ok
+}
+
+// exists ...
+func (db *memDB) exists(typ, key string) bool {
+	db.purge(typ, key)
+	var ok bool
+	switch typ {
+	case typeKV:
+		_, ok = db.kv[key]
+	case typeList:
+		_, ok = db.lists[key]
+	case typeHash:
+		_, ok = db.hashes[key]
+	case typeZSet:
+		_, ok = db.zsets[key]
+	case typeSet:
+		_, ok = db.sets[key]
+	}
+	return ok
+}
+
+// purge drops key of typ once its TTL has passed.
+func (db *memDB) purge(typ, key string) {
+	if deadline, ok := db.expires[typ+":"+key]; ok && !time.Now().Before(deadline) {
+		db.remove(typ, key)
+	}
+}
+
+// expire ...
+func (db *memDB) expire(typ, key string, ttl time.Duration) int64 {
+	if !db.exists(typ, key) {
+		return 0
+	}
+	db.expires[typ+":"+key] = time.Now().Add(ttl)
+	return 1
+}
+
+// memServer holds the databases of one memory store. All commands and
+// scripts run under mu, which makes every script atomic.
+type memServer struct {
+	mu      sync.Mutex
+	dbs     map[int]*memDB
+	scripts map[string]string
+}
+
+var memServers = struct {
+	sync.Mutex
+	servers map[string]*memServer
+}{servers: map[string]*memServer{}}
+
+// memServerNamed ...
+func memServerNamed(name string) *memServer {
+	memServers.Lock()
+	defer memServers.Unlock()
+	s, ok := memServers.servers[name]
+	if !ok {
+		s = &memServer{dbs: map[int]*memDB{}, scripts: map[string]string{}}
+		memServers.servers[name] = s
+	}
+	return s
+}
+
+// db ...
+func (s *memServer) db(index int) *memDB {
+	db, ok := s.dbs[index]
+	if !ok {
+		db = newMemDB()
+		s.dbs[index] = db
+	}
+	return db
+}
+
+var errSyntax = errors.New("ERR syntax error")
+
+// wrongArgs ...
+func wrongArgs(name string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// index normalizes a possibly negative list index.
+func index(i, n int64) int64 {
+	if i < 0 {
+		i += n
+	}
+	return i
+}
+
+// span clamps the inclusive range start..stop to a length of n.
+func span(start, stop, n int64) (int64, int64, bool) {
+	start, stop = index(start, n), index(stop, n)
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop && start < n
+}
+
+// formatScore ...
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// sortedMembers returns the members of a sorted set by ascending score.
+func sortedMembers(zset map[string]float64) []string {
+	members := []string{}
+	for member := range zset {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// exec runs one command against database *selected. The caller holds mu.
+func (s *memServer) exec(selected *int, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("ERR empty command")
+	}
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	db := s.db(*selected)
+	argc := func(n int) error {
+		if len(args) < n {
+			return wrongArgs(name)
+		}
+		return nil
+	}
+	integer := func(s string) (int64, error) {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, errors.New("ERR value is not an integer or out of range")
+		}
+		return n, nil
+	}
+
+	switch name {
+	case "PING":
+		return status("PONG"), nil
+	case "SELECT":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		n, err := integer(args[0])
+		if err != nil {
+			return nil, err
+		}
+		*selected = int(n)
+		return status("OK"), nil
+	case "SWAPDB":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		a, err := integer(args[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := integer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		s.dbs[int(a)], s.dbs[int(b)] = s.db(int(b)), s.db(int(a))
+		return status("OK"), nil
+	case "FLUSHDB":
+		s.dbs[*selected] = newMemDB()
+		return status("OK"), nil
+	case "FLUSHALL":
+		s.dbs = map[int]*memDB{}
+		return status("OK"), nil
+
+	case "GET":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeKV, args[0])
+		if v, ok := db.kv[args[0]]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SET", "SETNX":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		// SET key value [NX|XX] [EX seconds|PX milliseconds]
+		nx, xx := name == "SETNX", false
+		var ttl time.Duration
+		for i := 2; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); opt {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "EX", "PX":
+				if i+1 >= len(args) {
+					return nil, errors.New("ERR syntax error")
+				}
+				n, err := integer(args[i+1])
+				if err != nil || n <= 0 {
+					return nil, errors.New("ERR invalid expire time in set")
+				}
+				ttl = time.Duration(n) * time.Millisecond
+				if opt == "EX" {
+					ttl = time.Duration(n) * time.Second
+				}
+				i++
+			default:
+				return nil, errors.New("ERR syntax error")
+			}
+		}
+		db.purge(typeKV, args[0])
+		_, exists := db.kv[args[0]]
+		if (nx && exists) || (xx && !exists) {
+			if name == "SETNX" {
+				return int64(0), nil
+			}
+			return nil, nil
+		}
+		db.remove(typeKV, args[0])
+		db.kv[args[0]] = args[1]
+		if ttl > 0 {
+			db.expire(typeKV, args[0], ttl)
+		}
+		if name == "SETNX" {
+			return int64(1), nil
+		}
+		return status("OK"), nil
+	case "INCR":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeKV, args[0])
+		var n int64
+		if v, ok := db.kv[args[0]]; ok {
+			var err error
+			if n, err = integer(v); err != nil {
+				return nil, err
+			}
+		}
+		n++
+		db.kv[args[0]] = strconv.FormatInt(n, 10)
+		return n, nil
+	case "DEL":
+		// removes the key from every keyspace
+		var n int64
+		for _, key := range args {
+			for _, typ := range []string{typeKV, typeList, typeHash, typeZSet, typeSet} {
+				if db.exists(typ, key) && db.remove(typ, key) {
+					n++
+				}
+			}
+		}
+		return n, nil
+	case "EXPIRE", "PEXPIRE", "LEXPIRE", "HEXPIRE", "ZEXPIRE", "SEXPIRE":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		n, err := integer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		ttl := time.Duration(n) * time.Second
+		if name == "PEXPIRE" {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+		typ := map[string]string{"LEXPIRE": typeList, "HEXPIRE": typeHash, "ZEXPIRE": typeZSet, "SEXPIRE": typeSet}[name]
+		if typ != "" {
+			return db.expire(typ, args[0], ttl), nil
+		}
+		var expired int64
+		for _, typ := range []string{typeKV, typeList, typeHash, typeZSet, typeSet} {
+			if db.expire(typ, args[0], ttl) == 1 {
+				expired = 1
+			}
+		}
+		return expired, nil
+	case "PTTL", "TTL", "LTTL", "HTTL", "ZTTL", "STTL":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		unit := time.Second
+		if name == "PTTL" {
+			unit = time.Millisecond
+		}
+		types := []string{typeKV, typeList, typeHash, typeZSet, typeSet}
+		if typ := map[string]string{"TTL": typeKV, "LTTL": typeList, "HTTL": typeHash, "ZTTL": typeZSet, "STTL": typeSet}[name]; typ != "" {
+			types = []string{typ}
+		}
+		for _, typ := range types {
+			if !db.exists(typ, args[0]) {
+				continue
+			}
+			deadline, ok := db.expires[typ+":"+args[0]]
+			if !ok {
+				return int64(-1), nil
+			}
+			return int64(time.Until(deadline) / unit), nil
+		}
+		return int64(-2), nil
+	case "LCLEAR", "HCLEAR", "ZCLEAR", "SCLEAR":
+		// the LedisDB deletes of one keyspace, DEL above covers them all
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		typ := map[string]string{"LCLEAR": typeList, "HCLEAR": typeHash, "ZCLEAR": typeZSet, "SCLEAR": typeSet}[name]
+		if db.exists(typ, args[0]) && db.remove(typ, args[0]) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+
+	case "RPUSH":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeList, args[0])
+		db.lists[args[0]] = append(db.lists[args[0]], args[1:]...)
+		return int64(len(db.lists[args[0]])), nil
+	case "RPOP":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeList, args[0])
+		list := db.lists[args[0]]
+		if len(list) == 0 {
+			return nil, nil
+		}
+		db.lists[args[0]] = list[:len(list)-1]
+		if len(list) == 1 {
+			db.remove(typeList, args[0])
+		}
+		return list[len(list)-1], nil
+	case "LLEN":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeList, args[0])
+		return int64(len(db.lists[args[0]])), nil
+	case "LINDEX":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		i, err := integer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		db.purge(typeList, args[0])
+		list := db.lists[args[0]]
+		i = index(i, int64(len(list)))
+		if i < 0 || i >= int64(len(list)) {
+			return nil, nil
+		}
+		return list[i], nil
+	case "LRANGE":
+		if err := argc(3); err != nil {
+			return nil, err
+		}
+		start, err := integer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		stop, err := integer(args[2])
+		if err != nil {
+			return nil, err
+		}
+		db.purge(typeList, args[0])
+		list := db.lists[args[0]]
+		out := []interface{}{}
+		if start, stop, ok := span(start, stop, int64(len(list))); ok {
+			for _, v := range list[start : stop+1] {
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	case "LREM":
+		if err := argc(3); err != nil {
+			return nil, err
+		}
+		count, err := integer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		db.purge(typeList, args[0])
+		list := db.lists[args[0]]
+		kept := []string{}
+		var removed int64
+		if count >= 0 {
+			for _, v := range list {
+				if v == args[2] && (count == 0 || removed < count) {
+					removed++
+					continue
+				}
+				kept = append(kept, v)
+			}
+		} else {
+			for i := len(list) - 1; i >= 0; i-- {
+				if list[i] == args[2] && removed < -count {
+					removed++
+					continue
+				}
+				kept = append([]string{list[i]}, kept...)
+			}
+		}
+		if len(kept) == 0 {
+			db.remove(typeList, args[0])
+		} else {
+			db.lists[args[0]] = kept
+		}
+		return removed, nil
+
+	case "HGET":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		if v, ok := db.hashes[args[0]][args[1]]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "HSET", "HSETNX":
+		if err := argc(3); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		hash, ok := db.hashes[args[0]]
+		if !ok {
+			hash = map[string]string{}
+			db.hashes[args[0]] = hash
+		}
+		_, exists := hash[args[1]]
+		if exists && name == "HSETNX" {
+			return int64(0), nil
+		}
+		hash[args[1]] = args[2]
+		if exists {
+			return int64(0), nil
+		}
+		return int64(1), nil
+	case "HDEL":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		var n int64
+		for _, field := range args[1:] {
+			if _, ok := db.hashes[args[0]][field]; ok {
+				delete(db.hashes[args[0]], field)
+				n++
+			}
+		}
+		if len(db.hashes[args[0]]) == 0 {
+			db.remove(typeHash, args[0])
+		}
+		return n, nil
+	case "HEXISTS":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		if _, ok := db.hashes[args[0]][args[1]]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "HMGET":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		values := []interface{}{}
+		for _, field := range args[1:] {
+			if v, ok := db.hashes[args[0]][field]; ok {
+				values = append(values, v)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values, nil
+	case "HLEN":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		return int64(len(db.hashes[args[0]])), nil
+	case "HGETALL":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeHash, args[0])
+		fields := []string{}
+		for field := range db.hashes[args[0]] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		out := []interface{}{}
+		for _, field := range fields {
+			out = append(out, field, db.hashes[args[0]][field])
+		}
+		return out, nil
+
+	case "SADD", "SREM":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeSet, args[0])
+		set, ok := db.sets[args[0]]
+		if !ok {
+			set = map[string]bool{}
+			db.sets[args[0]] = set
+		}
+		var n int64
+		for _, member := range args[1:] {
+			if set[member] == (name == "SREM") {
+				n++
+			}
+			if name == "SADD" {
+				set[member] = true
+			} else {
+				delete(set, member)
+			}
+		}
+		if len(set) == 0 {
+			db.remove(typeSet, args[0])
+		}
+		return n, nil
+	case "SCARD":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeSet, args[0])
+		return int64(len(db.sets[args[0]])), nil
+	case "SISMEMBER":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeSet, args[0])
+		if db.sets[args[0]][args[1]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "SMEMBERS":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeSet, args[0])
+		members := []string{}
+		for member := range db.sets[args[0]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		out := []interface{}{}
+		for _, member := range members {
+			out = append(out, member)
+		}
+		return out, nil
+
+	case "ZADD", "ZINCRBY":
+		if err := argc(3); err != nil {
+			return nil, err
+		}
+		if len(args)%2 != 1 || (name == "ZINCRBY" && len(args) != 3) {
+			return nil, errSyntax
+		}
+		db.purge(typeZSet, args[0])
+		zset, ok := db.zsets[args[0]]
+		if !ok {
+			zset = map[string]float64{}
+			db.zsets[args[0]] = zset
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return nil, errors.New("ERR value is not a valid float")
+			}
+			if _, ok := zset[args[i+1]]; !ok {
+				added++
+			}
+			if name == "ZINCRBY" {
+				zset[args[i+1]] += score
+				return formatScore(zset[args[i+1]]), nil
+			}
+			zset[args[i+1]] = score
+		}
+		return added, nil
+	case "ZREM":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeZSet, args[0])
+		var n int64
+		for _, member := range args[1:] {
+			if _, ok := db.zsets[args[0]][member]; ok {
+				delete(db.zsets[args[0]], member)
+				n++
+			}
+		}
+		if len(db.zsets[args[0]]) == 0 {
+			db.remove(typeZSet, args[0])
+		}
+		return n, nil
+	case "ZSCORE":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		db.purge(typeZSet, args[0])
+		if score, ok := db.zsets[args[0]][args[1]]; ok {
+			return formatScore(score), nil
+		}
+		return nil, nil
+	case "ZCARD":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		db.purge(typeZSet, args[0])
+		return int64(len(db.zsets[args[0]])), nil
+	case "ZRANGE", "ZREVRANGE":
+		if err := argc(3); err != nil {
+			return nil, err
+		}
+		start, err := integer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		stop, err := integer(args[2])
+		if err != nil {
+			return nil, err
+		}
+		withScores := len(args) > 3 && strings.ToUpper(args[3]) == "WITHSCORES"
+		db.purge(typeZSet, args[0])
+		zset := db.zsets[args[0]]
+		members := sortedMembers(zset)
+		if name == "ZREVRANGE" {
+			for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+				members[i], members[j] = members[j], members[i]
+			}
+		}
+		out := []interface{}{}
+		if start, stop, ok := span(start, stop, int64(len(members))); ok {
+			for _, member := range members[start : stop+1] {
+				out = append(out, member)
+				if withScores {
+					out = append(out, formatScore(zset[member]))
+				}
+			}
+		}
+		return out, nil
+
+	case "EVAL", "EVALSHA":
+		if err := argc(2); err != nil {
+			return nil, err
+		}
+		src := args[0]
+		if name == "EVALSHA" {
+			var ok bool
+			if src, ok = s.scripts[strings.ToLower(args[0])]; !ok {
+				return nil, errors.New("NOSCRIPT No matching script. Please use EVAL.")
+			}
+		}
+		numkeys, err := integer(args[1])
+		if err != nil || numkeys < 0 || int(numkeys) > len(args)-2 {
+			return nil, errors.New("ERR Number of keys can't be greater than number of args")
+		}
+		s.scripts[NewScript(src).Hash] = src
+		return s.eval(selected, src, args[2:2+numkeys], args[2+numkeys:])
+	case "SCRIPT":
+		if err := argc(1); err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(args[0]) {
+		case "LOAD":
+			if err := argc(2); err != nil {
+				return nil, err
+			}
+			if err := Compile(args[1]); err != nil {
+				return nil, err
+			}
+			hash := NewScript(args[1]).Hash
+			s.scripts[hash] = args[1]
+			return hash, nil
+		case "EXISTS":
+			out := []interface{}{}
+			for _, hash := range args[1:] {
+				if _, ok := s.scripts[strings.ToLower(hash)]; ok {
+					out = append(out, int64(1))
+				} else {
+					out = append(out, int64(0))
+				}
+			}
+			return out, nil
+		case "FLUSH":
+			s.scripts = map[string]string{}
+			return status("OK"), nil
+		}
+		return nil, errSyntax
+	}
+	return nil, fmt.Errorf("ERR unknown command '%s'", strings.ToLower(name))
+}
+
+// argString formats a command argument the way go-redis writes it.
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(arg)
+}
+
+// Memory is the store that keeps its data in process.
+type Memory struct {
+	server *memServer
+	db     int
+}
+
+// NewMemory opens database db of the memory server called name.
+func NewMemory(name string, db int) *Memory {
+	return &Memory{server: memServerNamed(name), db: db}
+}
+
+// do ...
+func (m *Memory) do(args ...string) (interface{}, error) {
+	m.server.mu.Lock()
+	defer m.server.mu.Unlock()
+	selected := m.db
+	return m.server.exec(&selected, args)
+}
+
+// replyStrings ...
+func replyStrings(v interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, item := range v.([]interface{}) {
+		out = append(out, item.(string))
+	}
+	return out, nil
+}
+
+// replyString ...
+func replyString(v interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if v == nil {
+		return "", Nil
+	}
+	return v.(string), nil
+}
+
+// Ping ...
+func (m *Memory) Ping() error {
+	_, err := m.do("PING")
+	return err
+}
+
+// Close ...
+func (m *Memory) Close() error {
+	return nil
+}
+
+// FlushDB ...
+func (m *Memory) FlushDB() error {
+	_, err := m.do("FLUSHDB")
+	return err
+}
+
+// LLen ...
+func (m *Memory) LLen(key string) (int64, error) {
+	return Int64(m.do("LLEN", key))
+}
+
+// LIndex ...
+func (m *Memory) LIndex(key string, index int64) (string, error) {
+	return replyString(m.do("LINDEX", key, strconv.FormatInt(index, 10)))
+}
+
+// LRange ...
+func (m *Memory) LRange(key string, start, stop int64) ([]string, error) {
+	return replyStrings(m.do("LRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10)))
+}
+
+// HGet ...
+func (m *Memory) HGet(key, field string) (string, error) {
+	return replyString(m.do("HGET", key, field))
+}
+
+// HGetAll ...
+func (m *Memory) HGetAll(key string) (map[string]string, error) {
+	pairs, err := replyStrings(m.do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		out[pairs[i]] = pairs[i+1]
+	}
+	return out, nil
+}
+
+// HSet ...
+func (m *Memory) HSet(key, field, value string) error {
+	_, err := m.do("HSET", key, field, value)
+	return err
+}
+
+// HExists ...
+func (m *Memory) HExists(key, field string) (bool, error) {
+	n, err := Int64(m.do("HEXISTS", key, field))
+	return n == 1, err
+}
+
+// HMGet ...
+func (m *Memory) HMGet(key string, fields ...string) ([]interface{}, error) {
+	v, err := m.do(append([]string{"HMGET", key}, fields...)...)
+	if err != nil {
+		return nil, err
+	}
+	return v.([]interface{}), nil
+}
+
+// ZRevRange ...
+func (m *Memory) ZRevRange(key string, start, stop int64) ([]string, error) {
+	return replyStrings(m.do("ZREVRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10)))
+}
+
+// ZRangeWithScores ...
+func (m *Memory) ZRangeWithScores(key string, start, stop int64) ([]Z, error) {
+	pairs, err := replyStrings(m.do("ZRANGE", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	zs := []Z{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		score, _ := strconv.ParseFloat(pairs[i+1], 64)
+		zs = append(zs, Z{Score: score, Member: pairs[i]})
+	}
+	return zs, nil
+}
+
+// Eval runs script with EVALSHA like Redis does, loading it when it is
+// unknown.
+func (m *Memory) Eval(script *Script, keys []string, args ...interface{}) (interface{}, error) {
+	argv := []string{"EVALSHA", script.Hash, strconv.Itoa(len(keys))}
+	argv = append(argv, keys...)
+	for _, arg := range args {
+		argv = append(argv, argString(arg))
+	}
+	v, err := m.do(argv...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		if err := m.Load(script); err != nil {
+			return nil, err
+		}
+		v, err = m.do(argv...)
+	}
+	if s, ok := v.(status); ok {
+		return string(s), err
+	}
+	return v, err
+}
+
+// Load ...
+func (m *Memory) Load(script *Script) error {
+	_, err := m.do("SCRIPT", "LOAD", script.Src)
+	return err
+}
@@ -0,0 +1,99 @@
+package storage
+
+import "testing"
+
+// TestMemoryEval ...
+func TestMemoryEval(t *testing.T) {
+	m := NewMemory("TestMemoryEval", 0)
+	script := NewScript(`
+local pos = redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[2], pos)
+redis.call('ZADD', KEYS[1], 2.5, ARGV[2])
+return pos
+`)
+	for i, want := range []int64{1, 2} {
+		n, err := Int64(m.Eval(script, []string{"subject:news"}, []byte("msg"), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("position %d, want %d", n, want)
+		}
+	}
+	// lists and hashes have keyspaces of their own, as in LedisDB
+	if n, _ := m.LLen("subject:news"); n != 2 {
+		t.Fatalf("llen %d, want 2", n)
+	}
+	if v, _ := m.HGet("subject:news", "1"); v != "2" {
+		t.Fatalf("hget %s, want 2", v)
+	}
+	if zs, _ := m.ZRangeWithScores("subject:news", 0, -1); len(zs) != 2 || zs[0].Score != 2.5 {
+		t.Fatalf("zrange %v", zs)
+	}
+	if _, err := m.HGet("subject:news", "missing"); err != Nil {
+		t.Fatalf("missing field error %v, want Nil", err)
+	}
+	if vs, _ := m.HMGet("subject:news", "1", "missing"); len(vs) != 2 || vs[0] != "2" || vs[1] != nil {
+		t.Fatalf("hmget %v", vs)
+	}
+	if _, err := m.Eval(NewScript(`return redis.error_reply('boom')`), nil); err == nil || err.Error() != "boom" {
+		t.Fatalf("error reply %v", err)
+	}
+	if _, err := m.Eval(NewScript(`return redis.call('NOPE')`), nil); err == nil {
+		t.Fatal("unknown command did not fail the script")
+	}
+}
+
+// TestMemoryLoad ...
+func TestMemoryLoad(t *testing.T) {
+	m := NewMemory("TestMemoryLoad", 0)
+	script := NewScript(`return ARGV[1]`)
+	if err := m.Load(script); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.do("EVALSHA", script.Hash, "0", "x"); err != nil || v != "x" {
+		t.Fatalf("evalsha %v %v", v, err)
+	}
+	if err := m.Load(NewScript(`return (`)); err == nil {
+		t.Fatal("broken script loaded")
+	}
+}
+
+// TestMemorySwapDB ...
+func TestMemorySwapDB(t *testing.T) {
+	live, rebuilt := NewMemory("TestMemorySwapDB", 0), NewMemory("TestMemorySwapDB", 1)
+	live.HSet("offset", "t:0", "1")
+	rebuilt.HSet("offset", "t:0", "2")
+	script := NewScript(`redis.call('SELECT', ARGV[2]) redis.call('SWAPDB', ARGV[1], ARGV[2]) return 1`)
+	if _, err := live.Eval(script, nil, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := live.HGet("offset", "t:0"); v != "2" {
+		t.Fatalf("live offset %s after swap, want 2", v)
+	}
+}
+
+// TestMemoryClear ...
+func TestMemoryClear(t *testing.T) {
+	m := NewMemory("TestMemoryClear", 0)
+	script := NewScript(`
+redis.call('RPUSH', KEYS[1], 'a')
+redis.call('HSET', KEYS[1], 'f', 'v')
+redis.call('HEXPIRE', KEYS[1], 60)
+local ttl = redis.call('HTTL', KEYS[1])
+return {redis.call('LTTL', KEYS[1]), ttl, redis.call('LCLEAR', KEYS[1]), redis.call('LLEN', KEYS[1]), redis.call('HLEN', KEYS[1])}
+`)
+	v, err := m.Eval(script, []string{"subject:news"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := v.([]interface{})
+	if !ok || len(got) != 5 {
+		t.Fatalf("reply %v", v)
+	}
+	for i, want := range []int64{-1, 60, 1, 0, 1} {
+		if n, _ := got[i].(int64); n != want && !(i == 1 && n == 59) {
+			t.Fatalf("reply %d is %v, want %d", i, got[i], want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis is the store backed by a LedisDB or Redis server.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis ...
+func NewRedis(opts Options) *Redis {
+	return &Redis{client: redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})}
+}
+
+// Ping ...
+func (r *Redis) Ping() error {
+	return r.client.Ping().Err()
+}
+
+// Close ...
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// FlushDB ...
+func (r *Redis) FlushDB() error {
+	return r.client.FlushDB().Err()
+}
+
+// LLen ...
+func (r *Redis) LLen(key string) (int64, error) {
+	return r.client.LLen(key).Result()
+}
+
+// LIndex ...
+func (r *Redis) LIndex(key string, index int64) (string, error) {
+	return r.client.LIndex(key, index).Result()
+}
+
+// LRange ...
+func (r *Redis) LRange(key string, start, stop int64) ([]string, error) {
+	return r.client.LRange(key, start, stop).Result()
+}
+
+// HGet ...
+func (r *Redis) HGet(key, field string) (string, error) {
+	return r.client.HGet(key, field).Result()
+}
+
+// HGetAll ...
+func (r *Redis) HGetAll(key string) (map[string]string, error) {
+	return r.client.HGetAll(key).Result()
+}
+
+// HSet ...
+func (r *Redis) HSet(key, field, value string) error {
+	return r.client.HSet(key, field, value).Err()
+}
+
+// HExists ...
+func (r *Redis) HExists(key, field string) (bool, error) {
+	return r.client.HExists(key, field).Result()
+}
+
+// HMGet ...
+func (r *Redis) HMGet(key string, fields ...string) ([]interface{}, error) {
+	return r.client.HMGet(key, fields...).Result()
+}
+
+// ZRevRange ...
+func (r *Redis) ZRevRange(key string, start, stop int64) ([]string, error) {
+	return r.client.ZRevRange(key, start, stop).Result()
+}
+
+// ZRangeWithScores ...
+func (r *Redis) ZRangeWithScores(key string, start, stop int64) ([]Z, error) {
+	results, err := r.client.ZRangeWithScores(key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	zs := []Z{}
+	for _, result := range results {
+		member, _ := result.Member.(string)
+		zs = append(zs, Z{Score: result.Score, Member: member})
+	}
+	return zs, nil
+}
+
+// Eval runs script with EVALSHA, loading it when the server does not know
+// it yet.
+func (r *Redis) Eval(script *Script, keys []string, args ...interface{}) (interface{}, error) {
+	v, err := script.redis.EvalSha(r.client, keys, args...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		if err := r.Load(script); err != nil {
+			return nil, err
+		}
+		v, err = script.redis.EvalSha(r.client, keys, args...).Result()
+	}
+	return v, err
+}
+
+// Load ...
+func (r *Redis) Load(script *Script) error {
+	return script.redis.Load(r.client).Err()
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Server speaks the redis protocol in front of a memory store, so clients
+// using the redis backend can run against it without LedisDB.
+type Server struct {
+	server   *memServer
+	listener net.Listener
+}
+
+// NewServer serves the memory store called name on l.
+func NewServer(name string, l net.Listener) *Server {
+	return &Server{server: memServerNamed(name), listener: l}
+}
+
+// Addr ...
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections. Open connections end when their
+// clients close them.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// handle ...
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	selected := 0
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeReply(w, nil, fmt.Errorf("ERR Protocol error: %v", err))
+				w.Flush()
+			}
+			return
+		}
+		if len(args) > 0 && strings.ToUpper(args[0]) == "QUIT" {
+			writeReply(w, status("OK"), nil)
+			w.Flush()
+			return
+		}
+		s.server.mu.Lock()
+		v, err := s.server.exec(&selected, args)
+		s.server.mu.Unlock()
+		writeReply(w, v, err)
+		// flush once the pipelined commands already read are answered
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine ...
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readCommand reads a multi bulk request or an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got '%s'", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// writeReply encodes a reply of exec.
+func writeReply(w *bufio.Writer, v interface{}, err error) {
+	if err != nil {
+		fmt.Fprintf(w, "-%s\r\n", strings.Replace(err.Error(), "\n", " ", -1))
+		return
+	}
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item, nil)
+		}
+	default:
+		s := fmt.Sprint(v)
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+	}
+}
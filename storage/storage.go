@@ -0,0 +1,100 @@
+// Package storage is the ledis access shared by laidback and middleton.
+// Store covers the list, hash and sorted set reads the services make and
+// the Lua scripts laidback applies messages with. The redis backend talks
+// to LedisDB or Redis, the memory backend keeps everything in process.
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	BACKEND_REDIS  = "redis"
+	BACKEND_MEMORY = "memory"
+)
+
+// Nil is returned when a key or field does not exist.
+var Nil = redis.Nil
+
+// Z is a sorted set member with its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+type Store interface {
+	Ping() error
+	Close() error
+	FlushDB() error
+
+	LLen(key string) (int64, error)
+	LIndex(key string, index int64) (string, error)
+	LRange(key string, start, stop int64) ([]string, error)
+
+	HGet(key, field string) (string, error)
+	HGetAll(key string) (map[string]string, error)
+	HSet(key, field, value string) error
+	HExists(key, field string) (bool, error)
+	// HMGet returns the values of fields, nil where a field does not exist.
+	HMGet(key string, fields ...string) ([]interface{}, error)
+
+	ZRevRange(key string, start, stop int64) ([]string, error)
+	ZRangeWithScores(key string, start, stop int64) ([]Z, error)
+
+	// Eval runs script atomically. Integer replies come back as int64,
+	// bulk replies as string and arrays as []interface{}.
+	Eval(script *Script, keys []string, args ...interface{}) (interface{}, error)
+	// Load registers script with SCRIPT LOAD, so a script that does not
+	// compile fails before it is first run.
+	Load(script *Script) error
+}
+
+// Script is a Lua script in the dialect of Redis EVAL.
+type Script struct {
+	Src   string
+	Hash  string
+	redis *redis.Script
+}
+
+// NewScript ...
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{Src: src, Hash: hex.EncodeToString(sum[:]), redis: redis.NewScript(src)}
+}
+
+// Options ...
+type Options struct {
+	Backend  string
+	Addr     string
+	Password string
+	DB       int
+}
+
+// Open returns the store selected by opts.Backend, redis by default.
+// Memory stores opened with the same Addr share their data, so services
+// running in one process see each other's writes.
+func Open(opts Options) (Store, error) {
+	switch opts.Backend {
+	case "", BACKEND_REDIS:
+		return NewRedis(opts), nil
+	case BACKEND_MEMORY:
+		return NewMemory(opts.Addr, opts.DB), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// Int64 converts an Eval reply to int64.
+func Int64(v interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %T", v)
+	}
+	return n, nil
+}